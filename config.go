@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Settings kept between runs, stored as JSON in the user's config directory.
+// Empty fields keep the built-in defaults.
+type Config struct {
+	Directory string   `json:"directory,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	Mirrors   []string `json:"mirrors,omitempty"`
+	Downloads int      `json:"downloads,omitempty"`
+	MaxRate   int64    `json:"maxRate,omitempty"`
+}
+
+// configPath returns where the config file lives, e.g.
+// %AppData%\araxiapatch\config.json on Windows
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "araxiapatch", "config.json"), nil
+}
+
+// loadConfig reads the saved settings. A missing or unreadable file is not an
+// error, the defaults are used instead.
+func loadConfig() Config {
+	var config Config
+
+	path, err := configPath()
+	if err != nil {
+		return config
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Unable to read config", "path", path, "err", err)
+		}
+		return config
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		slog.Warn("Ignoring invalid config", "path", path, "err", err)
+		return Config{}
+	}
+	return config
+}
+
+// save writes the settings, creating the config directory if needed
+func (c Config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// rememberDirectory stores the install directory as the default for next time
+func rememberDirectory(config Config, directory string) {
+	if abs, err := filepath.Abs(directory); err == nil {
+		directory = abs
+	}
+	if config.Directory == directory {
+		return
+	}
+
+	config.Directory = directory
+	if err := config.save(); err != nil {
+		slog.Error("Unable to save config", "err", err)
+	}
+}
+
+// applySettings makes the saved download settings current. main calls it
+// before reading the command line so flags take precedence.
+func applySettings(config Config) {
+	if config.Source != "" {
+		settings.Source = config.Source
+		settings.Mirrors = config.Mirrors
+	}
+	if config.Downloads > 0 {
+		settings.MaxDownloads = config.Downloads
+	}
+	settings.MaxRate = config.MaxRate
+}
+
+// withSettings returns a copy of the config with the download settings taken
+// from the settings dialog, or an error describing the first invalid field.
+// An empty rate means no cap.
+func (c Config) withSettings(source string, mirrorList string, downloads int, rate string) (Config, error) {
+	source, err := normalizeSource(strings.TrimSpace(source))
+	if err != nil {
+		return c, err
+	}
+	mirrors, err := parseMirrors(mirrorList)
+	if err != nil {
+		return c, err
+	}
+	if downloads < 1 {
+		return c, fmt.Errorf("invalid number of downloads %d: must be at least 1", downloads)
+	}
+	var bytesPerSecond int64
+	if strings.TrimSpace(rate) != "" {
+		if bytesPerSecond, err = parseRate(rate); err != nil {
+			return c, err
+		}
+	}
+
+	c.Source = source
+	c.Mirrors = mirrors
+	c.Downloads = downloads
+	c.MaxRate = bytesPerSecond
+	return c, nil
+}
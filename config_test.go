@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigRoundTrips(t *testing.T) {
+	isolateConfig(t)
+	config := Config{
+		Directory: "/games/wow",
+		Source:    "https://cdn.example.com/patches/",
+		Mirrors:   []string{"https://mirror.example.com/"},
+		Downloads: 6,
+		MaxRate:   2 << 20,
+	}
+	if err := config.save(); err != nil {
+		t.Fatal(err)
+	}
+	got := loadConfig()
+	if got.Directory != config.Directory || got.Source != config.Source || len(got.Mirrors) != 1 ||
+		got.Mirrors[0] != config.Mirrors[0] || got.Downloads != config.Downloads || got.MaxRate != config.MaxRate {
+		t.Errorf("loaded %+v, want %+v", got, config)
+	}
+}
+
+func TestLoadConfigFallsBackToDefaults(t *testing.T) {
+	isolateConfig(t)
+	if config := loadConfig(); config.Directory != "" || config.Source != "" {
+		t.Errorf("missing config loaded as %+v", config)
+	}
+
+	path, err := configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"directory": "/games/wow", "downloads": "six"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if config := loadConfig(); config.Directory != "" || config.Downloads != 0 {
+		t.Errorf("corrupt config loaded as %+v", config)
+	}
+}
+
+func TestRememberDirectory(t *testing.T) {
+	isolateConfig(t)
+	rememberDirectory(Config{Source: "https://cdn.example.com/patches/"}, "Data")
+
+	config := loadConfig()
+	want, _ := filepath.Abs("Data")
+	if config.Directory != want {
+		t.Errorf("remembered %q, want %q", config.Directory, want)
+	}
+	if config.Source != "https://cdn.example.com/patches/" {
+		t.Errorf("remembering the directory dropped the source: %+v", config)
+	}
+}
+
+func TestRunHeadlessRemembersDirectory(t *testing.T) {
+	isolateConfig(t)
+	serveSource(t, map[string]string{"info.txt": "a.bin\n", "a.bin": "contents"})
+	saved := t.TempDir()
+	if err := (Config{Directory: saved}).save(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("saved directory", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if code := runHeadless(ctx, cancel, http.DefaultClient, Options{NoGUI: true}); code != 0 {
+			t.Fatalf("exit code %d, want 0", code)
+		}
+		if _, err := os.Stat(filepath.Join(saved, "a.bin")); err != nil {
+			t.Errorf("saved directory not patched: %v", err)
+		}
+	})
+
+	t.Run("-dir", func(t *testing.T) {
+		code, dir := headless(t, Options{NoGUI: true})
+		if code != 0 {
+			t.Fatalf("exit code %d, want 0", code)
+		}
+		if got := loadConfig().Directory; got != dir {
+			t.Errorf("remembered %q after -dir %s", got, dir)
+		}
+	})
+}
+
+func TestWithSettings(t *testing.T) {
+	base := Config{Directory: "/games/wow"}
+	config, err := base.withSettings(" https://cdn.example.com/patches ", "https://mirror.example.com", 6, "2MB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Directory != base.Directory || config.Source != "https://cdn.example.com/patches/" || len(config.Mirrors) != 1 ||
+		config.Mirrors[0] != "https://mirror.example.com/" || config.Downloads != 6 || config.MaxRate != 2<<20 {
+		t.Errorf("withSettings = %+v", config)
+	}
+	if config, err := base.withSettings("https://cdn.example.com/", "", 1, " "); err != nil || config.MaxRate != 0 || config.Mirrors != nil {
+		t.Errorf("no mirrors or rate cap = %+v, %v", config, err)
+	}
+
+	invalid := []struct {
+		field     string
+		source    string
+		mirrors   string
+		downloads int
+		rate      string
+	}{
+		{"source", "cdn.example.com", "", 4, ""},
+		{"mirror", "https://cdn.example.com/", "ftp://mirror.example.com", 4, ""},
+		{"downloads", "https://cdn.example.com/", "", 0, ""},
+		{"rate", "https://cdn.example.com/", "", 4, "fast"},
+	}
+	for _, test := range invalid {
+		config, err := base.withSettings(test.source, test.mirrors, test.downloads, test.rate)
+		if err == nil {
+			t.Errorf("invalid %s accepted as %+v", test.field, config)
+		}
+		if config.Source != "" || config.Directory != base.Directory {
+			t.Errorf("invalid %s changed the config to %+v", test.field, config)
+		}
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	isolateConfig(t)
+	saved := settings
+	t.Cleanup(func() { settings = saved })
+
+	config, err := (Config{}).withSettings("https://cdn.example.com/", "https://mirror.example.com/", 2, "512KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.save(); err != nil {
+		t.Fatal(err)
+	}
+	applySettings(loadConfig())
+	if settings.Source != "https://cdn.example.com/" || len(settings.Mirrors) != 1 || settings.MaxDownloads != 2 || settings.MaxRate != 512<<10 {
+		t.Errorf("settings after applying the saved ones = %+v", settings)
+	}
+
+	// Nothing saved keeps the built-in source and download count
+	settings = saved
+	applySettings(Config{})
+	if settings.Source != saved.Source || settings.MaxDownloads != saved.MaxDownloads || settings.MaxRate != 0 {
+		t.Errorf("settings after applying none = %+v", settings)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// sizeText formats bytes done out of total, e.g. "142.3 / 320.0 MB", or just
+// the bytes done when the total is unknown
+func sizeText(current int64, total int64) string {
+	if total <= 0 {
+		unit, divisor := i18n.ByteUnit(float64(current))
+		return i18n.FormatNumber(float64(current)/divisor, 1) + " " + unit
+	}
+	unit, divisor := i18n.ByteUnit(float64(total))
+	return i18n.FormatNumber(float64(current)/divisor, 1) + " / " + i18n.FormatNumber(float64(total)/divisor, 1) + " " + unit
+}
+
+// nameWidth returns the width the file name column needs for the widest of
+// names, as measured by advance, capped at limit so a very long name is
+// elided rather than squeezing the status and buttons
+func nameWidth(names []string, advance func(string) int, limit int) int {
+	width := 0
+	for _, name := range names {
+		width = max(width, advance(name))
+	}
+	return min(width, limit)
+}
+
+// elideMiddle shortens text to fit width, as measured by advance, by replacing
+// its middle with "…", so both the start and the extension of a long file name
+// stay visible
+func elideMiddle(text string, width int, advance func(string) int) string {
+	if advance(text) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for keep := len(runes) - 1; keep > 0; keep-- {
+		head := (keep + 1) / 2
+		elided := string(runes[:head]) + "…" + string(runes[len(runes)-(keep-head):])
+		if advance(elided) <= width {
+			return elided
+		}
+	}
+	return "…"
+}
+
+// percent returns how much of total is done, or -1 when the total is unknown
+func percent(current int64, total int64) int {
+	if total <= 0 {
+		return -1
+	}
+	return int(float64(current) / float64(total) * 100)
+}
+
+// speedText formats the rate and, when the remaining bytes are known (not -1)
+// and data is flowing, the time left, e.g. "3.20 MB/s — 00:42 left"
+func speedText(speed float64, remaining int64) string {
+	unit, divisor := i18n.ByteUnit(speed)
+	text := i18n.FormatNumber(speed/divisor, 2) + " " + unit + "/s"
+	if remaining < 0 || speed <= 0 {
+		return text
+	}
+
+	eta := time.Duration(float64(remaining) / speed * float64(time.Second))
+	return text + " — " + i18n.Tr("speed.left", formatETA(eta))
+}
+
+// formatETA renders a duration as mm:ss, or h:mm:ss once it passes an hour
+func formatETA(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+// repairSummary says how many files a repair found missing or damaged
+func repairSummary(result *patch.Result) string {
+	repaired := len(result.Repaired())
+	if repaired == 0 {
+		return i18n.Tr("dialog.intact")
+	}
+	return i18n.Tr("dialog.repaired", repaired, len(result.Files))
+}
+
+// planText lists each file with its action and size, followed by the total
+// to download
+func planText(plan []patch.FilePlan) string {
+	var text strings.Builder
+	var total int64
+	downloads := 0
+	for _, file := range plan {
+		size := i18n.Tr("plan.unknownSize")
+		if file.Size >= 0 {
+			size = sizeText(file.Size, -1)
+		}
+		fmt.Fprintf(&text, "%-12s %s (%s)\n", i18n.Tr("plan."+file.Action), file.File, size)
+
+		if file.Action != patch.ActionSkip {
+			downloads++
+			if file.Size > 0 {
+				total += file.Size
+			}
+		}
+	}
+	text.WriteString("\n" + i18n.Tr("plan.summary", downloads, len(plan), sizeText(total, -1)))
+	return text.String()
+}
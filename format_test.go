@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// advance measures text as a proportional font would, with narrow and wide
+// letters, in pixels
+func advance(text string) int {
+	width := 0
+	for _, r := range text {
+		switch r {
+		case 'i', 'l', '.':
+			width += 3
+		case 'W', 'M':
+			width += 12
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+func TestNameWidth(t *testing.T) {
+	short := []string{"patch-A.MPQ", "WWWW.MPQ", "li.txt"}
+	if got, want := nameWidth(short, advance, 320), advance("patch-A.MPQ"); got != want {
+		t.Errorf("width of short names = %d, want the widest, %d", got, want)
+	}
+	long := append(short, strings.Repeat("Interface/AddOns/", 10)+"Textures.MPQ")
+	if got := nameWidth(long, advance, 320); got != 320 {
+		t.Errorf("width with a long name = %d, want the 320 cap", got)
+	}
+	if got := nameWidth(nil, advance, 320); got != 0 {
+		t.Errorf("width of no names = %d", got)
+	}
+}
+
+func TestElideMiddle(t *testing.T) {
+	for _, name := range []string{"patch-A.MPQ", "WWWW.MPQ", "Data/enUS/patch-enUS-4.MPQ"} {
+		if advance(name) > 320 {
+			continue
+		}
+		if got := elideMiddle(name, 320, advance); got != name {
+			t.Errorf("elideMiddle(%q) = %q, want it unchanged", name, got)
+		}
+	}
+
+	long := "Data/" + strings.Repeat("Interface/AddOns/", 10) + "Textures-MMMM.MPQ"
+	for _, width := range []int{320, 100, 40} {
+		got := elideMiddle(long, width, advance)
+		if advance(got) > width {
+			t.Errorf("elided to %d pixels, %q is %d wide", width, got, advance(got))
+		}
+		head, tail, ok := strings.Cut(got, "…")
+		if !ok || !strings.HasPrefix(long, head) || !strings.HasSuffix(long, tail) {
+			t.Errorf("elided to %d pixels: %q, want the start and end of %q around an ellipsis", width, got, long)
+		}
+		if width >= 100 && (!strings.HasPrefix(got, "Data/") || !strings.HasSuffix(got, ".MPQ")) {
+			t.Errorf("elided to %d pixels: %q lost the directory or extension", width, got)
+		}
+	}
+
+	if got := elideMiddle("WWWW", 5, advance); got != "…" {
+		t.Errorf("elideMiddle with no room = %q, want just the ellipsis", got)
+	}
+}
+
+func TestRepairSummary(t *testing.T) {
+	result := &patch.Result{Repair: true, Files: []patch.FileResult{
+		{File: "a.MPQ", Success: true, Intact: true},
+		{File: "b.MPQ", Success: true},
+		{File: "c.MPQ", Success: true, Intact: true},
+	}}
+	if got, want := repairSummary(result), i18n.Tr("dialog.repaired", 1, 3); got != want {
+		t.Errorf("repairSummary = %q, want %q", got, want)
+	}
+	result.Files[1].Intact = true
+	if got, want := repairSummary(result), i18n.Tr("dialog.intact"); got != want {
+		t.Errorf("repairSummary of an intact install = %q, want %q", got, want)
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                                     "00:00",
+		42 * time.Second:                      "00:42",
+		59*time.Minute + 59*time.Second:       "59:59",
+		62*time.Minute + 300*time.Millisecond: "1:02:00",
+		25 * time.Hour:                        "25:00:00",
+	}
+	for d, want := range tests {
+		if got := formatETA(d); got != want {
+			t.Errorf("formatETA(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestSpeedText(t *testing.T) {
+	mb := float64(1024 * 1024)
+	tests := []struct {
+		speed     float64
+		remaining int64
+		want      string
+	}{
+		{3.2 * mb, int64(42 * 3.2 * mb), "3.20 MB/s — 00:42 left"},
+		// Unknown remaining bytes, or no data flowing, leave the time out
+		{3.2 * mb, -1, "3.20 MB/s"},
+		{0, 1000, "0.00 B/s"},
+		{512, 512 * 3600, "512.00 B/s — 1:00:00 left"},
+	}
+	for _, test := range tests {
+		if got := speedText(test.speed, test.remaining); got != test.want {
+			t.Errorf("speedText(%v, %d) = %q, want %q", test.speed, test.remaining, got, test.want)
+		}
+	}
+}
+
+func TestPlanText(t *testing.T) {
+	text := planText([]patch.FilePlan{
+		{File: "patch-A.MPQ", Action: patch.ActionSkip, Size: 2048},
+		{File: "patch-B.MPQ", Action: patch.ActionOverwrite, Size: 1024},
+		{File: "data.tar.gz", Action: patch.ActionDownload, Size: -1},
+	})
+	want := "skip         patch-A.MPQ (2.0 KB)\n" +
+		"overwrite    patch-B.MPQ (1.0 KB)\n" +
+		"download     data.tar.gz (unknown size)\n" +
+		"\n2 of 3 files to download, 1.0 KB"
+	if text != want {
+		t.Errorf("planText =\n%s\nwant\n%s", text, want)
+	}
+}
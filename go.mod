@@ -1,6 +1,6 @@
 module github.com/turleynerd/araxiapatch
 
-go 1.20
+go 1.21
 
 require github.com/therecipe/qt v0.0.0-20200904063919-c0c124a5770d
 
@@ -0,0 +1,277 @@
+// Package i18n holds the user-facing strings of the patcher in each supported
+// language
+package i18n
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Lang is the language strings are returned in, e.g. set from -lang or the OS
+// locale
+var Lang = "en"
+
+// catalogs holds the user-facing strings for each supported language. English
+// is complete; a key missing from another language falls back to it.
+var catalogs = map[string]map[string]string{
+	"en": {
+		"app.title":              "Araxia Client Patch Downloader",
+		"button.cancel":          "Cancel",
+		"button.close":           "Close",
+		"button.pause":           "Pause",
+		"button.resume":          "Resume",
+		"button.repair":          "Repair",
+		"button.settings":        "Settings…",
+		"settings.title":         "Download settings",
+		"settings.source":        "Patch source URL",
+		"settings.mirrors":       "Mirrors",
+		"settings.noMirrors":     "none, separate several with commas",
+		"settings.downloads":     "Downloads at once",
+		"settings.maxRate":       "Rate limit",
+		"settings.unlimited":     "unlimited, e.g. 2MB",
+		"status.paused":          "Paused",
+		"status.waiting":         "waiting…",
+		"status.retry":           "retry %d/%d…",
+		"status.mirror":          "mirror %d/%d…",
+		"status.upToDate":        "already up to date",
+		"status.extracting":      "Extracting…",
+		"status.streaming":       "Downloading and extracting…",
+		"status.manifest":        "Fetching the patch manifest…",
+		"status.patching":        "Patching…",
+		"status.done":            "Done",
+		"status.unverified":      "Done, not verified",
+		"status.verifying":       "Checking installed files…",
+		"status.intact":          "Intact",
+		"status.cancelled":       "Cancelled",
+		"failed.download":        "Download failed",
+		"failed.incomplete":      "Incomplete download",
+		"failed.checksum":        "Checksum mismatch",
+		"failed.extraction":      "Extraction failed",
+		"failed.partlyExtracted": "Cancelled part way through extracting",
+		"speed.left":             "%s left",
+		"dialog.manifest":        "Unable to read the patch manifest:\n%s",
+		"dialog.unable":          "Unable to patch:\n%s",
+		"dialog.dryRun":          "Dry run, nothing was changed:\n\n%s",
+		"dialog.chooseDir":       "Select your World of Warcraft Data directory",
+		"dialog.notWritable":     "The patch cannot be written to this directory:\n%s\n\nPlease choose another one.",
+		"dialog.failures":        "The patch was not fully applied. These files failed:",
+		"dialog.complete":        "Patch complete. You can now start the game.",
+		"dialog.unverified":      "%d files could not be verified, as checksums.txt has no checksum for them.",
+		"dialog.repaired":        "Repair complete: %d of %d files were missing or damaged and have been restored.",
+		"dialog.intact":          "Your install is intact, nothing needed repairing.",
+		"dialog.upToDate":        "Already up to date. You can start the game.",
+		"dialog.launchFailed":    "The patch is complete, but the game could not be started:\n%s",
+		"dialog.invalidSettings": "These settings cannot be used:\n%s",
+		"dialog.updateAvailable": "Version %s of the patcher is available, you have %s. Install it now? It is used the next time you start the patcher.",
+		"dialog.updated":         "The new patcher has been installed and is used the next time you start it.",
+		"dialog.updateFailed":    "Unable to update the patcher:\n%s",
+		"dialog.tooOld":          "This patch needs version %s of the patcher or later, you have %s. Please install a newer patcher before patching.",
+		"dialog.tooOldUpdate":    "This patch needs version %s of the patcher or later, you have %s. Install version %s now? Start the patcher again once it is installed to apply the patch.",
+		"text.noGUI":             "Built without GUI support, showing progress as text",
+		"text.downloaded":        "Downloaded %s",
+		"text.at":                "at %s",
+		"text.success":           "Patch applied successfully",
+		"text.upToDate":          "Already up to date",
+		"text.updateAvailable":   "Patcher version %s is available, you have %s. Start the patcher with a window to install it.",
+		"plan.download":          "download",
+		"plan.overwrite":         "overwrite",
+		"plan.skip":              "skip",
+		"plan.unknownSize":       "unknown size",
+		"plan.summary":           "%d of %d files to download, %s",
+		"unit.B":                 "B",
+		"unit.KB":                "KB",
+		"unit.MB":                "MB",
+		"unit.GB":                "GB",
+		"number.decimal":         ".",
+	},
+	"de": {
+		"app.title":              "Araxia Client Patch-Downloader",
+		"button.cancel":          "Abbrechen",
+		"button.close":           "Schließen",
+		"button.pause":           "Pausieren",
+		"button.resume":          "Fortsetzen",
+		"button.repair":          "Reparieren",
+		"button.settings":        "Einstellungen…",
+		"settings.title":         "Download-Einstellungen",
+		"settings.source":        "Patch-Quelle (URL)",
+		"settings.mirrors":       "Spiegel",
+		"settings.noMirrors":     "keine, mehrere durch Kommas trennen",
+		"settings.downloads":     "Gleichzeitige Downloads",
+		"settings.maxRate":       "Geschwindigkeitslimit",
+		"settings.unlimited":     "unbegrenzt, z. B. 2MB",
+		"status.paused":          "Pausiert",
+		"status.waiting":         "wartet…",
+		"status.retry":           "Versuch %d/%d…",
+		"status.mirror":          "Spiegel %d/%d…",
+		"status.upToDate":        "bereits aktuell",
+		"status.extracting":      "Entpacken…",
+		"status.streaming":       "Wird geladen und entpackt…",
+		"status.manifest":        "Patch-Manifest wird geladen…",
+		"status.patching":        "Wird gepatcht…",
+		"status.done":            "Fertig",
+		"status.unverified":      "Fertig, nicht geprüft",
+		"status.verifying":       "Installierte Dateien werden geprüft…",
+		"status.intact":          "Intakt",
+		"status.cancelled":       "Abgebrochen",
+		"failed.download":        "Download fehlgeschlagen",
+		"failed.incomplete":      "Download unvollständig",
+		"failed.checksum":        "Prüfsumme stimmt nicht",
+		"failed.extraction":      "Entpacken fehlgeschlagen",
+		"failed.partlyExtracted": "Während des Entpackens abgebrochen",
+		"speed.left":             "noch %s",
+		"dialog.manifest":        "Die Patch-Liste konnte nicht gelesen werden:\n%s",
+		"dialog.unable":          "Patchen nicht möglich:\n%s",
+		"dialog.dryRun":          "Probelauf, es wurde nichts geändert:\n\n%s",
+		"dialog.chooseDir":       "Wähle das Data-Verzeichnis deiner World-of-Warcraft-Installation",
+		"dialog.notWritable":     "In dieses Verzeichnis kann der Patch nicht geschrieben werden:\n%s\n\nBitte wähle ein anderes.",
+		"dialog.failures":        "Der Patch wurde nicht vollständig installiert. Diese Dateien sind fehlgeschlagen:",
+		"dialog.complete":        "Patch abgeschlossen. Du kannst das Spiel jetzt starten.",
+		"dialog.unverified":      "%d Dateien konnten nicht geprüft werden, da checksums.txt keine Prüfsumme für sie enthält.",
+		"dialog.repaired":        "Reparatur abgeschlossen: %d von %d Dateien fehlten oder waren beschädigt und wurden wiederhergestellt.",
+		"dialog.intact":          "Deine Installation ist intakt, es musste nichts repariert werden.",
+		"dialog.upToDate":        "Bereits aktuell. Du kannst das Spiel starten.",
+		"dialog.launchFailed":    "Der Patch ist abgeschlossen, aber das Spiel konnte nicht gestartet werden:\n%s",
+		"dialog.invalidSettings": "Diese Einstellungen können nicht verwendet werden:\n%s",
+		"dialog.updateAvailable": "Version %s des Patchers ist verfügbar, du hast %s. Jetzt installieren? Sie wird beim nächsten Start des Patchers verwendet.",
+		"dialog.updated":         "Der neue Patcher wurde installiert und wird beim nächsten Start verwendet.",
+		"dialog.updateFailed":    "Der Patcher konnte nicht aktualisiert werden:\n%s",
+		"dialog.tooOld":          "Dieser Patch braucht Version %s des Patchers oder neuer, du hast %s. Bitte installiere vor dem Patchen einen neueren Patcher.",
+		"dialog.tooOldUpdate":    "Dieser Patch braucht Version %s des Patchers oder neuer, du hast %s. Version %s jetzt installieren? Starte den Patcher danach neu, um den Patch zu installieren.",
+		"text.noGUI":             "Ohne GUI-Unterstützung erstellt, Fortschritt wird als Text angezeigt",
+		"text.downloaded":        "%s heruntergeladen",
+		"text.at":                "mit %s",
+		"text.success":           "Patch erfolgreich installiert",
+		"text.upToDate":          "Bereits aktuell",
+		"text.updateAvailable":   "Patcher-Version %s ist verfügbar, du hast %s. Starte den Patcher mit Fenster, um sie zu installieren.",
+		"plan.download":          "laden",
+		"plan.overwrite":         "ersetzen",
+		"plan.skip":              "überspringen",
+		"plan.unknownSize":       "Größe unbekannt",
+		"plan.summary":           "%d von %d Dateien herunterzuladen, %s",
+		"number.decimal":         ",",
+	},
+	"fr": {
+		"app.title":              "Téléchargeur de patch du client Araxia",
+		"button.cancel":          "Annuler",
+		"button.close":           "Fermer",
+		"button.pause":           "Pause",
+		"button.resume":          "Reprendre",
+		"button.repair":          "Réparer",
+		"button.settings":        "Paramètres…",
+		"settings.title":         "Paramètres de téléchargement",
+		"settings.source":        "URL de la source du patch",
+		"settings.mirrors":       "Miroirs",
+		"settings.noMirrors":     "aucun, séparez-en plusieurs par des virgules",
+		"settings.downloads":     "Téléchargements simultanés",
+		"settings.maxRate":       "Limite de débit",
+		"settings.unlimited":     "illimité, par ex. 2MB",
+		"status.paused":          "En pause",
+		"status.waiting":         "en attente…",
+		"status.retry":           "nouvel essai %d/%d…",
+		"status.mirror":          "miroir %d/%d…",
+		"status.upToDate":        "déjà à jour",
+		"status.extracting":      "Extraction…",
+		"status.streaming":       "Téléchargement et extraction…",
+		"status.manifest":        "Récupération du manifeste du patch…",
+		"status.patching":        "Application du correctif…",
+		"status.done":            "Terminé",
+		"status.unverified":      "Terminé, non vérifié",
+		"status.verifying":       "Vérification des fichiers installés…",
+		"status.intact":          "Intact",
+		"status.cancelled":       "Annulé",
+		"failed.download":        "Échec du téléchargement",
+		"failed.incomplete":      "Téléchargement incomplet",
+		"failed.checksum":        "Somme de contrôle incorrecte",
+		"failed.extraction":      "Échec de l'extraction",
+		"failed.partlyExtracted": "Annulé en cours d'extraction",
+		"speed.left":             "%s restantes",
+		"dialog.manifest":        "Impossible de lire la liste du patch :\n%s",
+		"dialog.unable":          "Impossible d'appliquer le patch :\n%s",
+		"dialog.dryRun":          "Simulation, rien n'a été modifié :\n\n%s",
+		"dialog.chooseDir":       "Choisissez le dossier Data de World of Warcraft",
+		"dialog.notWritable":     "Le patch ne peut pas être écrit dans ce dossier :\n%s\n\nVeuillez en choisir un autre.",
+		"dialog.failures":        "Le patch n'a pas été entièrement appliqué. Ces fichiers ont échoué :",
+		"dialog.complete":        "Patch terminé. Vous pouvez lancer le jeu.",
+		"dialog.unverified":      "%d fichiers n'ont pas pu être vérifiés, car checksums.txt ne contient pas leur somme de contrôle.",
+		"dialog.repaired":        "Réparation terminée : %d fichiers sur %d manquaient ou étaient endommagés et ont été restaurés.",
+		"dialog.intact":          "Votre installation est intacte, rien n'avait besoin d'être réparé.",
+		"dialog.upToDate":        "Déjà à jour. Vous pouvez lancer le jeu.",
+		"dialog.launchFailed":    "Le patch est terminé, mais le jeu n'a pas pu être lancé :\n%s",
+		"dialog.invalidSettings": "Ces paramètres ne peuvent pas être utilisés :\n%s",
+		"dialog.updateAvailable": "La version %s du patcher est disponible, vous avez la %s. L'installer maintenant ? Elle sera utilisée au prochain démarrage du patcher.",
+		"dialog.updated":         "Le nouveau patcher a été installé et sera utilisé au prochain démarrage.",
+		"dialog.updateFailed":    "Impossible de mettre à jour le patcher :\n%s",
+		"dialog.tooOld":          "Ce patch nécessite la version %s du patcher ou plus récente, vous avez la %s. Veuillez installer un patcher plus récent avant d'appliquer le patch.",
+		"dialog.tooOldUpdate":    "Ce patch nécessite la version %s du patcher ou plus récente, vous avez la %s. Installer la version %s maintenant ? Relancez ensuite le patcher pour appliquer le patch.",
+		"text.noGUI":             "Compilé sans interface graphique, progression affichée en texte",
+		"text.downloaded":        "%s téléchargés",
+		"text.at":                "à %s",
+		"text.success":           "Patch appliqué avec succès",
+		"text.upToDate":          "Déjà à jour",
+		"text.updateAvailable":   "La version %s du patcher est disponible, vous avez la %s. Lancez le patcher avec une fenêtre pour l'installer.",
+		"plan.download":          "télécharger",
+		"plan.overwrite":         "remplacer",
+		"plan.skip":              "ignorer",
+		"plan.unknownSize":       "taille inconnue",
+		"plan.summary":           "%d fichiers sur %d à télécharger, %s",
+		"unit.B":                 "o",
+		"unit.KB":                "Ko",
+		"unit.MB":                "Mo",
+		"unit.GB":                "Go",
+		"number.decimal":         ",",
+	},
+}
+
+// Tr returns the string for key in the current language, formatted with args
+// when given. Missing translations fall back to English, then to the key.
+func Tr(key string, args ...any) string {
+	text, ok := catalogs[Lang][key]
+	if !ok {
+		text, ok = catalogs["en"][key]
+	}
+	if !ok {
+		text = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// Supported reports whether there is a catalog for language
+func Supported(language string) bool {
+	_, ok := catalogs[language]
+	return ok
+}
+
+// Match maps a locale such as "de_DE.UTF-8" or "fr-CA" to a supported
+// language, or English when there is no catalog for it
+func Match(locale string) string {
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "_-.@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if Supported(locale) {
+		return locale
+	}
+	return "en"
+}
+
+// FormatNumber formats value with the given number of decimals using the
+// current language's decimal separator
+func FormatNumber(value float64, decimals int) string {
+	return strings.Replace(fmt.Sprintf("%.*f", decimals, value), ".", Tr("number.decimal"), 1)
+}
+
+// ByteUnit picks a display unit for a byte count, in the current language,
+// and the divisor to scale it by
+func ByteUnit(bytes float64) (string, float64) {
+	if bytes < 1024 {
+		return Tr("unit.B"), 1
+	} else if bytes < 1024*1024 {
+		return Tr("unit.KB"), 1024
+	} else if bytes < 1024*1024*1024 {
+		return Tr("unit.MB"), 1024 * 1024
+	}
+	return Tr("unit.GB"), 1024 * 1024 * 1024
+}
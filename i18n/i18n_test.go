@@ -0,0 +1,106 @@
+package i18n
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// withLang makes language current for the rest of the test
+func withLang(t *testing.T, language string) {
+	t.Helper()
+	saved := Lang
+	Lang = language
+	t.Cleanup(func() { Lang = saved })
+}
+
+// Formatting verbs, which a translation must keep in the same order
+var verbs = regexp.MustCompile(`%[-+# 0]*[0-9*]*(\.[0-9*]*)?[a-zA-Z%]`)
+
+func TestCatalogsMatchEnglish(t *testing.T) {
+	for language, catalog := range catalogs {
+		for key, text := range catalog {
+			english, ok := catalogs["en"][key]
+			if !ok {
+				t.Errorf("%s has %s, which English does not", language, key)
+				continue
+			}
+			if got, want := verbs.FindAllString(text, -1), verbs.FindAllString(english, -1); !slices.Equal(got, want) {
+				t.Errorf("%s %s formats %q, English %q", language, key, got, want)
+			}
+		}
+	}
+}
+
+func TestTrFallsBack(t *testing.T) {
+	withLang(t, "de")
+	if got := Tr("button.cancel"); got != catalogs["de"]["button.cancel"] {
+		t.Errorf("Tr(button.cancel) = %q, want the German", got)
+	}
+	// German has no units of its own
+	if got := Tr("unit.KB"); got != "KB" {
+		t.Errorf("Tr(unit.KB) = %q, want the English", got)
+	}
+	if got := Tr("no.such.key"); got != "no.such.key" {
+		t.Errorf("Tr of an unknown key = %q, want the key", got)
+	}
+
+	withLang(t, "xx")
+	if got := Tr("button.cancel"); got != "Cancel" {
+		t.Errorf("Tr(button.cancel) in an unknown language = %q, want the English", got)
+	}
+	if got, want := Tr("plan.summary", 2, 3, "1.0 KB"), "2 of 3 files to download, 1.0 KB"; got != want {
+		t.Errorf("Tr(plan.summary) = %q, want %q", got, want)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := map[string]string{
+		"de_DE.UTF-8": "de",
+		"fr-CA":       "fr",
+		"FR":          "fr",
+		"de@euro":     "de",
+		"en_US":       "en",
+		"es_ES.UTF-8": "en",
+		"C":           "en",
+		"":            "en",
+	}
+	for locale, want := range tests {
+		if got := Match(locale); got != want {
+			t.Errorf("Match(%q) = %q, want %q", locale, got, want)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := map[string]string{"en": "1234.57", "de": "1234,57", "fr": "1234,57"}
+	for language, want := range tests {
+		withLang(t, language)
+		if got := FormatNumber(1234.567, 2); got != want {
+			t.Errorf("%s: FormatNumber = %q, want %q", language, got, want)
+		}
+	}
+	withLang(t, "de")
+	if got := FormatNumber(42, 0); got != "42" {
+		t.Errorf("FormatNumber(42, 0) = %q", got)
+	}
+}
+
+func TestByteUnit(t *testing.T) {
+	withLang(t, "fr")
+	tests := []struct {
+		bytes   float64
+		unit    string
+		divisor float64
+	}{
+		{512, "o", 1},
+		{2048, "Ko", 1024},
+		{5 << 20, "Mo", 1 << 20},
+		{3 << 30, "Go", 1 << 30},
+	}
+	for _, test := range tests {
+		if unit, divisor := ByteUnit(test.bytes); unit != test.unit || divisor != test.divisor {
+			t.Errorf("ByteUnit(%v) = %s, %v, want %s, %v", test.bytes, unit, divisor, test.unit, test.divisor)
+		}
+	}
+}
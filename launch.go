@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// launchIfPatched starts the game given with -launch, but only once every file
+// has been downloaded, verified and extracted. It reports whether the game
+// was started.
+func launchIfPatched(result *patch.Result) (bool, error) {
+	if launchPath == "" || result == nil || !result.Success {
+		return false, nil
+	}
+
+	slog.Info("Launching game", "path", launchPath)
+	cmd := exec.Command(launchPath)
+	cmd.Dir = filepath.Dir(launchPath)
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	// The game outlives the patcher, nothing waits for it
+	return true, cmd.Process.Release()
+}
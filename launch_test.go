@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// launchWith makes path the game given with -launch for the rest of the test
+func launchWith(t *testing.T, path string) {
+	t.Helper()
+	saved := launchPath
+	launchPath = path
+	t.Cleanup(func() { launchPath = saved })
+}
+
+func TestLaunchIfPatchedNeedsSuccess(t *testing.T) {
+	// Starting this would fail the test, so it must never be tried
+	launchWith(t, filepath.Join(t.TempDir(), "missing.exe"))
+	failed := &patch.Result{Files: []patch.FileResult{{File: "a.bin", Success: true}, {File: "b.bin", Error: "HTTP 404"}}}
+	for name, result := range map[string]*patch.Result{"no result": nil, "failed": failed} {
+		if launched, err := launchIfPatched(result); launched || err != nil {
+			t.Errorf("%s: launched = %v, %v", name, launched, err)
+		}
+	}
+
+	launchWith(t, "")
+	if launched, err := launchIfPatched(&patch.Result{Success: true}); launched || err != nil {
+		t.Errorf("without -launch: launched = %v, %v", launched, err)
+	}
+}
+
+func TestLaunchIfPatchedStartsGame(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in game is a shell script")
+	}
+	dir := t.TempDir()
+	game := filepath.Join(dir, "wow.sh")
+	// Run from its own directory, as the game expects
+	if err := os.WriteFile(game, []byte("#!/bin/sh\ntouch launched\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	launchWith(t, game)
+
+	if launched, err := launchIfPatched(&patch.Result{Success: true}); !launched || err != nil {
+		t.Fatalf("launched = %v, %v", launched, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(dir, "launched")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("game did not run in its directory")
+		}
+	}
+
+	launchWith(t, filepath.Join(dir, "missing.sh"))
+	if launched, err := launchIfPatched(&patch.Result{Success: true}); launched || err == nil {
+		t.Errorf("missing game: launched = %v, %v", launched, err)
+	}
+}
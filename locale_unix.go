@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// systemLocale returns the user's locale from the usual environment
+// variables, e.g. "de_DE.UTF-8", or "" if none is set
+func systemLocale() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" && locale != "C" && locale != "POSIX" {
+			return locale
+		}
+	}
+	return ""
+}
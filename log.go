@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The log file is rotated once it reaches maxLogSize, keeping logBackups old
+// files next to it as araxiapatch.log.1, .2 and so on
+var maxLogSize int64 = 1024 * 1024
+var logBackups = 3
+
+// setupLogging sends the default slog logger to the log file in the user's
+// cache directory, and also to the console when there is no window. If the
+// log file cannot be opened the console is used instead. The returned func
+// closes the file.
+func setupLogging(verbose bool, console bool) func() {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+
+	var out io.Writer = os.Stdout
+	closeLog := func() {}
+
+	file, err := openLogFile()
+	if err != nil {
+		fmt.Println("Unable to open log file, logging to the console:", err)
+	} else if console {
+		out = io.MultiWriter(file, os.Stdout)
+		closeLog = file.close
+	} else {
+		out = file
+		closeLog = file.close
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})))
+	return closeLog
+}
+
+// logPath returns where the log file lives, e.g.
+// %LocalAppData%\araxiapatch\araxiapatch.log on Windows
+func logPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "araxiapatch", "araxiapatch.log"), nil
+}
+
+func openLogFile() (*rotatingFile, error) {
+	path, err := logPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// rotatingFile appends to a log file, moving it aside once it grows past
+// maxLogSize. Downloads log from their own goroutines, so writes are locked.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > maxLogSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a
+// new log file
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+
+	for i := logBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if logBackups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.file.Close()
+}
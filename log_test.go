@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// logTo sends the log to the log file for the rest of the test and returns
+// a func reading what was written so far
+func logTo(t *testing.T, verbose bool) func() string {
+	t.Helper()
+	isolateConfig(t)
+	saved := slog.Default()
+	closeLog := setupLogging(verbose, false)
+	t.Cleanup(func() {
+		closeLog()
+		slog.SetDefault(saved)
+	})
+	return func() string {
+		path, err := logPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestFailedDownloadIsLoggedAsError(t *testing.T) {
+	read := logTo(t, false)
+	serveSource(t, map[string]string{"info.txt": "missing.bin\n"})
+	if code, _ := headless(t, Options{NoGUI: true}); code != 1 {
+		t.Fatalf("exit code %d, want 1", code)
+	}
+
+	var found bool
+	for _, line := range strings.Split(read(), "\n") {
+		if strings.Contains(line, "level=ERROR") && strings.Contains(line, `msg="Download failed"`) && strings.Contains(line, "file=missing.bin") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no error logged for missing.bin:\n%s", read())
+	}
+}
+
+func TestVerboseLogsDebug(t *testing.T) {
+	for _, verbose := range []bool{false, true} {
+		read := logTo(t, verbose)
+		slog.Debug("debug line")
+		if got := strings.Contains(read(), "debug line"); got != verbose {
+			t.Errorf("verbose %v: debug logged = %v", verbose, got)
+		}
+	}
+}
+
+func TestLogFileRotates(t *testing.T) {
+	savedSize, savedBackups := maxLogSize, logBackups
+	maxLogSize, logBackups = 100, 2
+	t.Cleanup(func() { maxLogSize, logBackups = savedSize, savedBackups })
+	isolateConfig(t)
+
+	file, err := openLogFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	for i := 0; i < 5; i++ {
+		if _, err := fmt.Fprintf(file, "%d%s\n", i, strings.Repeat("x", 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, _ := logPath()
+	for suffix, want := range map[string]string{"": "4", ".1": "3", ".2": "2"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || !strings.HasPrefix(string(data), want) {
+			t.Errorf("log%s = %.10q, %v, want line %s", suffix, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than %d old logs kept: %v", logBackups, err)
+	}
+}
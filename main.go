@@ -1,293 +1,113 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"io"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
-	"time"
-	"archive/tar"
-	"compress/gzip"
+	"syscall"
 
-	"github.com/therecipe/qt/core"
-	"github.com/therecipe/qt/widgets"
+	"github.com/turleynerd/araxiapatch/i18n"
+	"github.com/turleynerd/araxiapatch/patch"
 )
 
-type ProgressBarWindow struct {
-	app          *widgets.QApplication
-	window       *widgets.QWidget
-	layout       *widgets.QVBoxLayout
-	bars         []*ProgressBar
-	maxNameWidth int
-	done         chan bool
-}
-
-type ProgressBar struct {
-	order       int
-	total       int64
-	current     int64
-	file        string
-	progressBar *widgets.QProgressBar
-	label       *widgets.QLabel
-}
-
-// Files to download
-var files = []string{
-	"info.txt",
-	"AraxiaPatchv1.tar.gz",
-	"HDPatchv1.tar.gz",
-}
+// Files to download, as listed by the manifest
+var files []string
 
-var patchSource = "https://storage.googleapis.com/araxia-client-patches/Updatev1/"
+// Window and dialog title, translated once the language is known
 var appName = "Araxia Client Patch Downloader"
 
-func main() {
-	catchInterrupt()
-
-	app := widgets.NewQApplication(len(os.Args), os.Args)
-	// Window setup
-	window := widgets.NewQWidget(nil, 0)
-	window.SetWindowTitle(appName)
-	title := widgets.NewQLabel2(appName, nil, 0)
-	title.Font().SetPointSize(20)
-	title.Font().SetFamily("Arial")
-	title.SetAlignment(core.Qt__AlignCenter)
-	window.SetMinimumSize2(800, 600)
-
-	// Build layout
-	layout := widgets.NewQVBoxLayout()
-	window.SetLayout(layout)
-	layout.AddWidget(title, 0, core.Qt__AlignCenter)
-
-	progressBarWindow := ProgressBarWindow{
-		app:    app,
-		window: window,
-		layout: layout,
-		done:   make(chan bool),
-	}
+// Download settings: the built-in defaults, then the saved config, then the
+// command line. Each run gets its own copy, see patchConfig.
+var settings = patch.Config{Source: patch.DefaultSource, MaxDownloads: patch.DefaultMaxDownloads}
 
-	progressBarWindow.calculateMaxNameWidth()
-	progressBarWindow.initProgressBars()
-
-	go progressBarWindow.run()
-
-	closeButton := widgets.NewQPushButton2("Close", nil)
-	closeButton.ConnectClicked(func(bool) {
-		app.Quit()
-	})
-	layout.AddWidget(closeButton, 0, core.Qt__AlignRight)
-
-	window.Show()
-
-	app.Exec()
-}
-
-func (p *ProgressBarWindow) calculateMaxNameWidth() {
-	for _, file := range files {
-		if len(file) > p.maxNameWidth {
-			p.maxNameWidth = len(file)
-		}
-	}
-}
+// Game started after a successful patch, empty to just exit
+var launchPath string
 
-func (p *ProgressBarWindow) initProgressBars() {
-	for i, file := range files {
-		progressBar := NewProgressBar(i+1, file, p.maxNameWidth)
-		p.bars = append(p.bars, progressBar)
-
-		// Create labels for filename and download speed
-		filenameLabel := widgets.NewQLabel2(file, nil, 0)
-		filenameLabel.SetFixedWidth(p.maxNameWidth * 8)
-
-		// Create a horizontal layout for the labels and progress bar
-		labelLayout := widgets.NewQHBoxLayout2(nil)
-		labelLayout.AddWidget(filenameLabel, 0, core.Qt__AlignTop)
-		labelLayout.AddWidget(progressBar.label, 0, core.Qt__AlignTop)
-
-		// Create a vertical layout to hold the labels and progress bar
-		progressLayout := widgets.NewQVBoxLayout()
-		progressLayout.AddLayout(labelLayout, 0)
-		progressLayout.AddWidget(progressBar.progressBar, 0, core.Qt__AlignTop)
-
-		p.layout.AddLayout(progressLayout, 0)
-	}
-}
-
-func (p *ProgressBarWindow) run() {
-	directory := "."
-	if len(os.Args) > 1 {
-		directory = os.Args[1]
-	}
-
-	// create channel to wait for all downloads to finish
-	done := make(chan bool)
-
-	// Download each file in parallel
-	for i, file := range files {
-		go p.downloadFile(directory, file, i+1, done)
-	}
-
-	// Wait for all downloads to finish
-	for i := 0; i < len(files); i++ {
-		<-done
-	}
-
-	// Untar gz the patch files
-	for _, file := range files {
-		fmt.Println("Untarring", file)
-		err := untarGz(directory+"/"+file, directory)
-		if err != nil {
-			fmt.Println("Error untarring file:", file, err)
-		}
-	}
-
-}
-
-func untarGz(src string, dest string) error {
-	// Open gzip file
-	gzipFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-
-	// Check if file has tar.gz extension if not skip the file
-	if gzipFile.Name()[len(gzipFile.Name())-6:] != ".tar.gz" {
-		return nil
-	}
-
-	gzipReader, err := gzip.NewReader(gzipFile)
-	if err != nil {
-		return err
-	}
-
-	tarReader := tar.NewReader(gzipReader)
-
-	// Iterate through the files in the archive
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return err
-		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(dest+"/"+header.Name, 0755); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			outFile, err := os.Create(dest + "/" + header.Name)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return err
-			}
-			outFile.Close()
-		default:
-			fmt.Printf("Unable to untar type : %c in file %s", header.Typeflag, header.Name)
-		}
-	}
-
-	return nil
-}
-
-func (p *ProgressBarWindow) downloadFile(directory string, file string, order int, done chan bool) {
-	out, err := os.Create(directory + "/" + file)
-	if err != nil {
-		fmt.Println("Error creating file:", file)
-		return
+func main() {
+	applySettings(loadConfig())
+	options, err := parseOptions(os.Args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
 	}
-	defer out.Close()
-
-	resp, err := http.Get(patchSource + file)
 	if err != nil {
-		fmt.Println("Error downloading file:", file)
-		return
-	}
-	defer resp.Body.Close()
-
-	progressBar := p.bars[order-1]
-	progressBar.total = resp.ContentLength
-
-	start := time.Now()
-	lastTime := start
-	lastBytes := int64(0)
-
-	buf := make([]byte, 1024) // Buffer for calculating download speed
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			out.Write(buf[:n])
-			progressBar.current += int64(n)
-			now := time.Now()
-			elapsed := now.Sub(lastTime).Seconds()
-			if elapsed >= 1 { // Update speed label every second
-				speed := float64(progressBar.current-lastBytes) / elapsed
-				updateSpeedLabel(progressBar.label, speed)
-				lastBytes = progressBar.current
-				lastTime = now
-			}
-			updateProgressBar(progressBar.progressBar, progressBar.current, progressBar.total)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Println("Error writing file:", file, err)
-			return
-		}
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	i18n.Lang = options.Lang
+	if i18n.Lang == "" {
+		i18n.Lang = i18n.Match(systemLocale())
+	}
+	appName = i18n.Tr("app.title")
+
+	settings.Source = options.Source
+	settings.Mirrors = options.Mirrors
+	settings.MaxRate = options.MaxRate
+	settings.KeepArchives = options.KeepArchives
+	settings.Backup = options.Backup
+	settings.Stream = options.Stream
+	settings.Repair = options.Repair
+	launchPath = options.Launch
+
+	// Without a window the console is the only place to see what happened
+	headless := options.NoGUI || !guiAvailable || !hasDisplay()
+	closeLog := setupLogging(options.Verbose, headless)
+	removeOldBinary()
+
+	// Cancelled by the Close button or an interrupt to stop every download
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := patch.NewClient(options.Proxy)
+
+	var code int
+	if headless {
+		code = runHeadless(ctx, cancel, client, options)
+	} else {
+		code = runGUI(ctx, cancel, client, options)
 	}
-
-	done <- true
+	closeLog()
+	os.Exit(code)
 }
 
-func NewProgressBar(order int, file string, maxNameWidth int) *ProgressBar {
-	progressBar := widgets.NewQProgressBar(nil)
-	progressBar.SetMinimum(0)
-	progressBar.SetMaximum(100)
-	progressBar.SetValue(0)
-
-	label := widgets.NewQLabel2("", nil, 0)
-	label.SetFixedWidth(maxNameWidth * 8)
-
-	return &ProgressBar{
-		order:       order,
-		file:        file,
-		progressBar: progressBar,
-		label:       label,
-	}
+// patchConfig returns the download settings for a run over directory
+func patchConfig(directory string) patch.Config {
+	config := settings
+	config.Directory = directory
+	return config
 }
 
-func updateProgressBar(progressBar *widgets.QProgressBar, current int64, total int64) {
-	percent := float32(current) / float32(total) * 100
-	progressBar.SetValue(int(percent))
-}
+// Exit code after an interrupt, as a shell reports a process killed by SIGINT
+const exitInterrupted = 130
 
-func updateSpeedLabel(label *widgets.QLabel, speed float64) {
-	var speedLabel string
-	if speed < 1024 {
-		speedLabel = fmt.Sprintf("%.2f B/s", speed)
-	} else if speed < 1024*1024 {
-		speedLabel = fmt.Sprintf("%.2f KB/s", speed/1024)
-	} else {
-		speedLabel = fmt.Sprintf("%.2f MB/s", speed/1024/1024)
+// exitCode returns the process exit code for a patch run: 0 only if every file
+// was applied
+func exitCode(result *patch.Result, interrupted bool) int {
+	switch {
+	case interrupted:
+		return exitInterrupted
+	case result == nil || !result.Success:
+		return 1
 	}
-	label.SetText(speedLabel)
+	return 0
 }
 
-// catch interrupt signal and exit
-func catchInterrupt() {
+// catch interrupt and termination signals and call stop so the downloads end
+// and their files are closed before the program exits. The handler is removed
+// after the first signal or once ctx is done, so a second interrupt kills the
+// program straight away.
+func catchInterrupt(ctx context.Context, stop func()) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range c {
-			fmt.Printf("Received %v, exiting.\n", sig)
-			os.Exit(1)
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			slog.Info("Received signal, exiting", "signal", sig.String())
+			stop()
+		case <-ctx.Done():
 		}
 	}()
 }
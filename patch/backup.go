@@ -0,0 +1,121 @@
+package patch
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory inside the install directory that Config.Backup moves replaced
+// files to, one timestamped subdirectory per run
+var backupDir = ".araxiapatch-backup"
+
+// backup keeps the files an extraction replaces so a failed patch can be
+// rolled back. A nil *backup does nothing, which is how backups are turned off.
+type backup struct {
+	// Deltas are saved from the download goroutines
+	mu    sync.Mutex
+	dest  string
+	dir   string
+	seen  map[string]bool
+	saved []backedUp
+}
+
+// backedUp is one file touched by the patch. saved is where the original now
+// lives, or empty if the file did not exist before.
+type backedUp struct {
+	path  string
+	saved string
+}
+
+func newBackup(dest string) *backup {
+	return &backup{
+		dest: dest,
+		dir:  filepath.Join(dest, backupDir, time.Now().Format("20060102-150405")),
+		seen: make(map[string]bool),
+	}
+}
+
+// save moves whatever is at target into the backup before the archive writes
+// over it. target has already been through safeJoin, so it is inside dest and
+// keeps the same relative path in the backup. Only the first write to a path
+// is recorded; later ones would only back up this patch's own files.
+func (b *backup) save(target string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seen[target] {
+		return nil
+	}
+	b.seen[target] = true
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		b.saved = append(b.saved, backedUp{path: target})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	rel, err := filepath.Rel(b.dest, target)
+	if err != nil {
+		return err
+	}
+	saved := filepath.Join(b.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(saved), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(target, saved); err != nil {
+		return err
+	}
+	b.saved = append(b.saved, backedUp{path: target, saved: saved})
+	return nil
+}
+
+// restore undoes the patch, newest change first: originals are moved back and
+// files the patch added are removed
+func (b *backup) restore() error {
+	if b == nil {
+		return nil
+	}
+
+	var errs []error
+	for i := len(b.saved) - 1; i >= 0; i-- {
+		file := b.saved[i]
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		if file.saved == "" {
+			continue
+		}
+		if err := os.Rename(file.saved, file.path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		os.RemoveAll(b.dir)
+	}
+	return errors.Join(errs...)
+}
+
+// restoreBackup rolls back a failed patch, logging how it went
+func restoreBackup(b *backup) {
+	if b == nil || len(b.saved) == 0 {
+		return
+	}
+	slog.Info("Patch failed, restoring backed up files", "files", len(b.saved), "backup", b.dir)
+	if err := b.restore(); err != nil {
+		slog.Error("Unable to restore all backed up files", "backup", b.dir, "err", err)
+	}
+}
@@ -0,0 +1,96 @@
+package patch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backups returns the run directories in the backup of dir
+func backups(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, backupDir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var runs []string
+	for _, entry := range entries {
+		runs = append(runs, filepath.Join(dir, backupDir, entry.Name()))
+	}
+	return runs
+}
+
+// backupConfig patches an install holding data/a.txt from an earlier patch
+func backupConfig(t *testing.T, source string) Config {
+	t.Helper()
+	config := testConfig(t, source)
+	config.Backup = true
+	if err := os.MkdirAll(filepath.Join(config.Directory, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.Directory, "data", "a.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestRunBacksUpReplacedFiles(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.tar.gz": tarGz(t, tarEntry{name: "data/a.txt", body: "new"}, tarEntry{name: "data/b.txt", body: "added"}),
+	})
+	config := backupConfig(t, server.URL)
+	if result, _ := runPatcher(t, config, "p.tar.gz"); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+
+	if got := readFile(t, config.Directory, "data/a.txt"); got != "new" {
+		t.Errorf("data/a.txt = %q, want the patched file", got)
+	}
+	runs := backups(t, config.Directory)
+	if len(runs) != 1 {
+		t.Fatalf("backup holds %d runs, want 1", len(runs))
+	}
+	if got := readFile(t, runs[0], "data/a.txt"); got != "old" {
+		t.Errorf("backed up data/a.txt = %q, want the original", got)
+	}
+	// Nothing was there before, so there is nothing to keep
+	if exists(runs[0], "data/b.txt") {
+		t.Error("added data/b.txt was backed up")
+	}
+}
+
+func TestFailedRunRestoresBackup(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.tar.gz": tarGz(t, tarEntry{name: "data/a.txt", body: "new"}, tarEntry{name: "data/b.txt", body: "added"}),
+	})
+	config := backupConfig(t, server.URL)
+	// missing.bin is not on the server, which fails the patch
+	if result, _ := runPatcher(t, config, "p.tar.gz", "missing.bin"); result.Success {
+		t.Fatal("patch succeeded with a missing file")
+	}
+
+	if got := readFile(t, config.Directory, "data/a.txt"); got != "old" {
+		t.Errorf("data/a.txt = %q, want the original restored", got)
+	}
+	if exists(config.Directory, "data/b.txt") {
+		t.Error("data/b.txt added by the failed patch was left behind")
+	}
+	if runs := backups(t, config.Directory); len(runs) != 0 {
+		t.Errorf("restored backup left %v", runs)
+	}
+}
+
+func TestBackupOffLeavesNoCopies(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{"p.tar.gz": tarGz(t, tarEntry{name: "data/a.txt", body: "new"})})
+	config := backupConfig(t, server.URL)
+	config.Backup = false
+	if result, _ := runPatcher(t, config, "p.tar.gz", "missing.bin"); result.Success {
+		t.Fatal("patch succeeded with a missing file")
+	}
+	if got := readFile(t, config.Directory, "data/a.txt"); got != "new" {
+		t.Errorf("data/a.txt = %q, want it left as extracted", got)
+	}
+	if _, err := os.Stat(filepath.Join(config.Directory, backupDir)); !os.IsNotExist(err) {
+		t.Errorf("backup directory made without Backup: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package patch
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic at the start of a patch made by bsdiff 4
+var bsdiffMagic = []byte("BSDIFF40")
+
+// bspatch rebuilds a file from old and a bsdiff 4 patch, writing the result
+// to out. The patch is a 32 byte header followed by three bzip2 streams: the
+// control triples, the bytes to add to old and the bytes to insert. Old is read
+// at random, the new file is written front to back, so neither has to fit in
+// memory.
+func bspatch(old io.ReaderAt, oldSize int64, patch io.ReaderAt, patchSize int64, out io.Writer) error {
+	header := make([]byte, 32)
+	if _, err := patch.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("reading patch header: %w", err)
+	}
+	if !bytes.Equal(header[:8], bsdiffMagic) {
+		return errors.New("not a bsdiff 4 patch")
+	}
+	ctrlLen := offtin(header[8:16])
+	diffLen := offtin(header[16:24])
+	newSize := offtin(header[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > patchSize {
+		return errors.New("corrupt patch header")
+	}
+
+	ctrl := bzip2.NewReader(io.NewSectionReader(patch, 32, ctrlLen))
+	diff := bzip2.NewReader(io.NewSectionReader(patch, 32+ctrlLen, diffLen))
+	extra := bzip2.NewReader(io.NewSectionReader(patch, 32+ctrlLen+diffLen, patchSize-32-ctrlLen-diffLen))
+
+	var oldPos, newPos int64
+	triple := make([]byte, 24)
+	buf := make([]byte, 32*1024)
+	oldBuf := make([]byte, len(buf))
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, triple); err != nil {
+			return fmt.Errorf("reading patch control block: %w", err)
+		}
+		add := offtin(triple[0:8])
+		insert := offtin(triple[8:16])
+		seek := offtin(triple[16:24])
+		if add < 0 || insert < 0 || newPos+add+insert > newSize {
+			return errors.New("corrupt patch control block")
+		}
+
+		// Add the diff bytes to the old bytes at the same offset, where old
+		// has any
+		for add > 0 {
+			n := int64(len(buf))
+			if add < n {
+				n = add
+			}
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return fmt.Errorf("reading patch diff block: %w", err)
+			}
+			if err := readOld(old, oldSize, oldPos, oldBuf[:n]); err != nil {
+				return err
+			}
+			for i := int64(0); i < n; i++ {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			add -= n
+			oldPos += n
+			newPos += n
+		}
+
+		if _, err := io.CopyN(out, extra, insert); err != nil {
+			return fmt.Errorf("reading patch extra block: %w", err)
+		}
+		newPos += insert
+		oldPos += seek
+	}
+
+	return nil
+}
+
+// readOld fills p with old's bytes from pos, using zeros for the parts that
+// fall outside of it as bsdiff expects
+func readOld(old io.ReaderAt, oldSize int64, pos int64, p []byte) error {
+	clear(p)
+	start, end := pos, pos+int64(len(p))
+	if start < 0 {
+		start = 0
+	}
+	if end > oldSize {
+		end = oldSize
+	}
+	if start >= end {
+		return nil
+	}
+	if _, err := old.ReadAt(p[start-pos:end-pos], start); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// offtin decodes bsdiff's 64 bit integer: little endian magnitude with the
+// sign in the top bit
+func offtin(b []byte) int64 {
+	value := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,73 @@
+package patch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Checksum list published next to the patch files, in sha256sum format
+var checksumFile = "checksums.txt"
+
+// FetchChecksums downloads the checksum list from the first of sources that
+// has it and returns the expected SHA-256 for each file name
+func FetchChecksums(ctx context.Context, client *http.Client, sources []string) (map[string]string, error) {
+	resp, err := Fetch(ctx, client, sources, checksumFile)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return parseChecksums(resp.Body)
+}
+
+// parseChecksums reads "<hex digest>  <file>" lines as written by sha256sum,
+// ignoring blank lines and # comments
+func parseChecksums(r io.Reader) (map[string]string, error) {
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed checksum line: %q", line)
+		}
+
+		sum := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+			return nil, fmt.Errorf("malformed checksum for %s: %q", fields[1], fields[0])
+		}
+
+		// sha256sum marks binary mode with a leading *
+		checksums[strings.TrimPrefix(fields[1], "*")] = sum
+	}
+
+	return checksums, scanner.Err()
+}
+
+// fileChecksum hashes a file on disk, returning its SHA-256 and size
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
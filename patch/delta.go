@@ -0,0 +1,158 @@
+package patch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// Delta updates one install file by patching the local copy instead of
+// downloading the file whole
+type Delta struct {
+	// Install file the delta applies to, also listed in the manifest's Files
+	File string
+	// SHA-256 of the local file the patch was made from, and of the result
+	Base   string
+	Target string
+	// Name of the bsdiff patch on the patch source
+	Patch string
+}
+
+// checkDeltas hashes the local copy of every delta file once, before anything
+// is downloaded. The target hash becomes the file's checksum, so a copy that is
+// already patched counts as up to date; a copy matching the base is patched.
+// Anything else falls back to downloading the whole file.
+func (p *Patcher) checkDeltas() {
+	if len(p.deltas) > 0 && p.checksums == nil {
+		p.checksums = make(map[string]string)
+	}
+	for _, download := range p.downloads {
+		delta, ok := p.deltas[download.file]
+		if !ok {
+			continue
+		}
+		p.checksums[delta.File] = delta.Target
+
+		sum, _, err := fileChecksum(p.directory + "/" + delta.File)
+		download.usePatch = err == nil && sum == delta.Base
+		slog.Debug("Checked delta base", "file", delta.File, "patch", download.usePatch)
+	}
+}
+
+// remoteName returns the name of what will be downloaded for file: its delta
+// patch when the local copy can be patched, otherwise the file itself
+func (p *Patcher) remoteName(download *download) string {
+	if download.usePatch {
+		return p.deltas[download.file].Patch
+	}
+	return download.file
+}
+
+// downloadDelta brings a delta file up to date. The patch is downloaded and
+// applied to the local copy straight away, as there is nothing to extract. If
+// the copy cannot be patched, or patching fails, the whole file is downloaded
+// in place of it. Replaced files are saved to p.bak.
+func (p *Patcher) downloadDelta(order int) error {
+	download := p.downloads[order-1]
+	file := download.file
+	path := p.directory + "/" + file
+
+	if download.usePatch {
+		delta := p.deltas[file]
+		patchPath := p.directory + "/" + delta.Patch
+		if err := p.downloadWithRetry(delta.Patch, order); err != nil {
+			return err
+		}
+		if !p.config.KeepArchives {
+			defer removeArchive(patchPath)
+		}
+
+		p.progress.FileStatus(order, i18n.Tr("status.patching"))
+		err := applyDelta(path, patchPath, delta.Target, p.bak)
+		if err == nil {
+			slog.Info("Patched", "file", file, "patch", delta.Patch)
+			return nil
+		}
+		if p.ctx.Err() != nil {
+			return err
+		}
+		slog.Error("Unable to apply delta, downloading the whole file", "file", file, "patch", delta.Patch, "err", err)
+	}
+
+	if p.upToDate(path, download) {
+		return nil
+	}
+	// The download replaces the stale copy once it is complete
+	if err := p.bak.save(path); err != nil {
+		return err
+	}
+	download.current.Store(0)
+	return p.downloadWithRetry(file, order)
+}
+
+// applyDelta patches the file at path with the bsdiff patch at patchPath. The
+// result is written next to it and only replaces it once it matches target.
+func applyDelta(path string, patchPath string, target string, bak *backup) error {
+	tmp := path + ".patched"
+	if err := writePatched(path, patchPath, tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := bak.save(path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writePatched writes the patched file to tmp and checks its hash
+func writePatched(path string, patchPath string, tmp string, target string) error {
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return err
+	}
+
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return err
+	}
+	defer patch.Close()
+	patchInfo, err := patch.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, oldInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	writer := bufio.NewWriterSize(io.MultiWriter(out, hasher), bufferSize)
+	if err := bspatch(old, oldInfo.Size(), patch, patchInfo.Size(), writer); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != target {
+		return fmt.Errorf("checksum mismatch for patched %s: expected %s, got %s", path, target, sum)
+	}
+	return nil
+}
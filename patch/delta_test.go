@@ -0,0 +1,113 @@
+package patch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The delta fixture patches old.bin into new.bin. It was made to change bytes
+// in place, insert new ones and seek both ways through old.bin.
+func deltaFixture(t *testing.T) (old []byte, target []byte, patch []byte) {
+	t.Helper()
+	files := make([][]byte, 3)
+	for i, name := range []string{"old.bin", "new.bin", "old-to-new.bsdiff"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = data
+	}
+	return files[0], files[1], files[2]
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBspatch(t *testing.T) {
+	old, want, patch := deltaFixture(t)
+	var out bytes.Buffer
+	if err := bspatch(bytes.NewReader(old), int64(len(old)), bytes.NewReader(patch), int64(len(patch)), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("bspatch wrote %q, want %q", out.Bytes(), want)
+	}
+}
+
+func TestBspatchRejectsCorruptPatches(t *testing.T) {
+	old, _, patch := deltaFixture(t)
+	badMagic := append([]byte("BSDIFF41"), patch[8:]...)
+	tests := map[string][]byte{
+		"not a patch":      []byte("MPQ\x1a not a bsdiff patch at all, only long enough"),
+		"wrong magic":      badMagic,
+		"short header":     patch[:20],
+		"cut off":          patch[:len(patch)-20],
+		"lengths too long": append(append([]byte{}, patch[:8]...), bytes.Repeat([]byte{0x7f}, 24)...),
+	}
+	for name, patch := range tests {
+		err := bspatch(bytes.NewReader(old), int64(len(old)), bytes.NewReader(patch), int64(len(patch)), &bytes.Buffer{})
+		if err == nil {
+			t.Errorf("%s: patch applied", name)
+		}
+	}
+}
+
+// deltaManifest offers a.bin in full and as a.bsdiff from old to target
+func deltaManifest(old []byte, target []byte) Manifest {
+	return Manifest{
+		Files:  []string{"a.bin"},
+		Deltas: []Delta{{File: "a.bin", Base: sha256Hex(old), Target: sha256Hex(target), Patch: "a.bsdiff"}},
+	}
+}
+
+func TestRunAppliesDeltas(t *testing.T) {
+	old, target, patch := deltaFixture(t)
+	tests := []struct {
+		name  string
+		local []byte
+		patch []byte
+		// Requests expected for the patch and for the whole file
+		patchGets, fileGets int
+	}{
+		{"base present", old, patch, 1, 0},
+		{"base changed", []byte("something else"), patch, 0, 1},
+		{"no local copy", nil, patch, 0, 1},
+		{"corrupt patch", old, patch[:len(patch)-20], 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, gets := serveGets(t, map[string][]byte{"a.bin": target, "a.bsdiff": test.patch})
+			config := testConfig(t, server.URL)
+			if test.local != nil {
+				if err := os.WriteFile(filepath.Join(config.Directory, "a.bin"), test.local, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			progress := newTestProgress()
+			result := New(context.Background(), http.DefaultClient, config, deltaManifest(old, target), progress).Run()
+			if result == nil || !result.Success {
+				t.Fatalf("patch failed: %+v", result)
+			}
+			if got := readFile(t, config.Directory, "a.bin"); got != string(target) {
+				t.Errorf("a.bin = %q, want %q", got, target)
+			}
+			if gets("a.bsdiff") != test.patchGets || gets("a.bin") != test.fileGets {
+				t.Errorf("fetched a.bsdiff %d and a.bin %d times, want %d and %d", gets("a.bsdiff"), gets("a.bin"), test.patchGets, test.fileGets)
+			}
+			for _, leftover := range []string{"a.bsdiff", "a.bin.patched"} {
+				if exists(config.Directory, leftover) {
+					t.Errorf("%s left behind", leftover)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package patch
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// Room needed to extract the archives, as a multiple of their download size
+var extractionMargin = 2.0
+
+// spaceError reports that the install directory is too full to patch
+type spaceError struct {
+	required  uint64
+	available uint64
+}
+
+func (e *spaceError) Error() string {
+	requiredUnit, requiredDivisor := i18n.ByteUnit(float64(e.required))
+	availableUnit, availableDivisor := i18n.ByteUnit(float64(e.available))
+	return fmt.Sprintf("not enough disk space: %.1f %s required, %.1f %s available",
+		float64(e.required)/requiredDivisor, requiredUnit,
+		float64(e.available)/availableDivisor, availableUnit)
+}
+
+// requiredSpace estimates the bytes a patch needs on disk: the downloads
+// themselves plus room to extract them
+func requiredSpace(downloadSize int64) uint64 {
+	return uint64(float64(downloadSize) * (1 + extractionMargin))
+}
+
+// checkSpace compares the space a download needs against what is available
+func checkSpace(downloadSize int64, available uint64) error {
+	required := requiredSpace(downloadSize)
+	if required > available {
+		return &spaceError{required: required, available: available}
+	}
+	return nil
+}
+
+// checkDiskSpace makes sure the install directory has room for the patch
+// before anything is written. Files whose size is unknown (-1) are left out
+// of the estimate.
+func checkDiskSpace(directory string, sizes []int64) error {
+	available, err := freeSpace(directory)
+	if err != nil {
+		slog.Warn("Unable to determine free disk space", "directory", directory, "err", err)
+		return nil
+	}
+
+	var downloadSize int64
+	for _, size := range sizes {
+		if size > 0 {
+			downloadSize += size
+		}
+	}
+
+	return checkSpace(downloadSize, available)
+}
+
+// CheckWritable makes sure files can be created in directory by creating and
+// removing an empty one
+func CheckWritable(directory string) error {
+	f, err := os.CreateTemp(directory, ".araxiapatch-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,42 @@
+package patch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckSpace(t *testing.T) {
+	// A 100 byte download needs 300 bytes with room to extract it
+	if err := checkSpace(100, 300); err != nil {
+		t.Errorf("300 bytes for a 100 byte patch: %v", err)
+	}
+	var spaceErr *spaceError
+	if err := checkSpace(100, 299); !errors.As(err, &spaceErr) || spaceErr.required != 300 || spaceErr.available != 299 {
+		t.Errorf("299 bytes for a 100 byte patch: %v, want a spaceError", err)
+	}
+	if err := checkSpace(0, 0); err != nil {
+		t.Errorf("nothing to download on a full disk: %v", err)
+	}
+}
+
+func TestRunRefusesWithoutDiskSpace(t *testing.T) {
+	server, gets := serveGets(t, map[string][]byte{"a.bin": []byte("contents")})
+	config := testConfig(t, server.URL)
+	// No disk is big enough for an 8 byte file with this much room to extract it
+	saved := extractionMargin
+	extractionMargin = 1e18
+	t.Cleanup(func() { extractionMargin = saved })
+
+	progress := newTestProgress()
+	if result := New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin"}}, progress).Run(); result != nil {
+		t.Fatalf("patch ran without room for it: %+v", result)
+	}
+	if len(progress.errors) != 1 {
+		t.Errorf("errors shown %q, want the disk space one", progress.errors)
+	}
+	if gets("a.bin") != 0 || exists(config.Directory, "a.bin"+partSuffix) {
+		t.Error("a.bin was downloaded without room for it")
+	}
+}
@@ -0,0 +1,487 @@
+package patch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extract unpacks a downloaded archive into dest, picking the format from the
+// file's first bytes rather than its name, and reports whether src was an
+// archive. Anything that is neither zip nor gzip is left alone, as untarGz
+// always has, so plain files in the manifest stay where they were downloaded.
+// Files that would be replaced are first moved into bak, which may be nil.
+func extract(src string, dest string, bak *backup, rec *entryRecorder, progress func(read int64, total int64)) (bool, error) {
+	isZip, err := hasZipMagic(src)
+	if err != nil {
+		return false, err
+	}
+	if isZip {
+		return true, unzip(src, dest, bak, rec, progress)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	isGzip, err := hasGzipMagic(f)
+	f.Close()
+	if err != nil || !isGzip {
+		return false, err
+	}
+	return true, untarGz(src, dest, bak, rec, progress)
+}
+
+// untarGz extracts a gzipped tar archive into dest, calling progress with the
+// compressed bytes read so far and the archive size. Files that are not gzip
+// are skipped. An entry that cannot be written does not stop the others; the
+// failed entries are reported together once the archive has been read.
+func untarGz(src string, dest string, bak *backup, rec *entryRecorder, progress func(read int64, total int64)) error {
+	// Open gzip file
+	gzipFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer gzipFile.Close()
+
+	// Check the file starts with the gzip magic bytes if not skip the file
+	isGzip, err := hasGzipMagic(gzipFile)
+	if err != nil {
+		return err
+	}
+	if !isGzip {
+		return nil
+	}
+
+	info, err := gzipFile.Stat()
+	if err != nil {
+		return err
+	}
+	counter := &countingReader{r: gzipFile, total: info.Size(), progress: progress}
+
+	_, err = untarStream(counter, filepath.Base(src), dest, bak, rec)
+	return err
+}
+
+// untarStream extracts a gzipped tar archive read from r into dest, so it
+// works on a file as well as straight from a download. A bad entry is logged
+// and skipped so the rest of the archive still applies; only a broken stream
+// stops the extraction. name identifies the archive in errors. The number of
+// entries written is returned even when the extraction stops early.
+func untarStream(r io.Reader, name string, dest string, bak *backup, rec *entryRecorder) (int, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+
+	failed := &extractError{archive: name}
+	written := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		if err := untarEntry(tarReader, header, dest, bak, rec); err != nil {
+			slog.Error("Unable to extract entry", "archive", name, "name", header.Name, "err", err)
+			failed.add(header.Name, err)
+			continue
+		}
+		written++
+	}
+
+	// The tar ends before the gzip trailer, whose checksum is only verified
+	// once the rest of the stream has been read
+	if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+		return written, err
+	}
+	return written, failed.err()
+}
+
+// untarEntry writes the tar entry described by header, whose contents are
+// read from tarReader, into dest, recording regular files in rec
+func untarEntry(tarReader *tar.Reader, header *tar.Header, dest string, bak *backup, rec *entryRecorder) error {
+	target, err := safeJoin(dest, header.Name)
+	if err != nil {
+		return err
+	}
+	if err := checkParent(dest, target); err != nil {
+		return err
+	}
+
+	// Permissions come from the archive and are still narrowed by the umask.
+	// The owner always keeps write access so a later patch can replace them.
+	mode := header.FileInfo().Mode().Perm()
+
+	// As in zip files, the entries for parent directories may be missing
+	if header.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, mode|0700)
+	case tar.TypeReg:
+		if err := bak.save(target); err != nil {
+			return err
+		}
+		if err := removeSymlink(target); err != nil {
+			return err
+		}
+		outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0600)
+		if err != nil {
+			return err
+		}
+		defer outFile.Close()
+		if err := rec.copy(target, outFile, tarReader); err != nil {
+			return err
+		}
+		return outFile.Close()
+	case tar.TypeSymlink:
+		if err := safeLink(dest, target, header.Linkname); err != nil {
+			return err
+		}
+		if err := bak.save(target); err != nil {
+			return err
+		}
+		return replaceWith(target, func() error { return os.Symlink(header.Linkname, target) })
+	case tar.TypeLink:
+		source, err := safeJoin(dest, header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := checkInside(dest, source, header.Linkname); err != nil {
+			return err
+		}
+		if err := bak.save(target); err != nil {
+			return err
+		}
+		return replaceWith(target, func() error { return os.Link(source, target) })
+	default:
+		slog.Warn("Skipping unsupported tar entry", "type", string(header.Typeflag), "name", header.Name)
+	}
+	return nil
+}
+
+// unzip extracts a zip archive into dest with the same path and permission
+// rules as untarGz, calling progress with the uncompressed bytes written so
+// far and the total. Like untarGz it carries on past entries that fail.
+func unzip(src string, dest string, bak *backup, rec *entryRecorder, progress func(read int64, total int64)) error {
+	zipReader, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	var total int64
+	for _, f := range zipReader.File {
+		total += int64(f.UncompressedSize64)
+	}
+	counter := &countingReader{total: total, progress: progress}
+
+	failed := &extractError{archive: filepath.Base(src)}
+	for _, f := range zipReader.File {
+		if err := unzipEntry(f, dest, bak, rec, counter); err != nil {
+			slog.Error("Unable to extract entry", "archive", src, "name", f.Name, "err", err)
+			failed.add(f.Name, err)
+		}
+	}
+
+	return failed.err()
+}
+
+// unzipEntry writes one zip entry of any type into dest, recording regular
+// files in rec
+func unzipEntry(f *zip.File, dest string, bak *backup, rec *entryRecorder, counter *countingReader) error {
+	target, err := safeJoin(dest, f.Name)
+	if err != nil {
+		return err
+	}
+	if err := checkParent(dest, target); err != nil {
+		return err
+	}
+
+	mode := f.Mode().Perm()
+
+	// Zip files often leave out the entries for their directories
+	if !f.FileInfo().IsDir() {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case f.FileInfo().IsDir():
+		return os.MkdirAll(target, mode|0700)
+	case f.Mode()&os.ModeSymlink != 0:
+		linkname, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		if err := safeLink(dest, target, linkname); err != nil {
+			return err
+		}
+		if err := bak.save(target); err != nil {
+			return err
+		}
+		return replaceWith(target, func() error { return os.Symlink(linkname, target) })
+	case f.Mode().IsRegular():
+		if err := bak.save(target); err != nil {
+			return err
+		}
+		if err := removeSymlink(target); err != nil {
+			return err
+		}
+		return unzipFile(f, target, mode|0600, rec, counter)
+	default:
+		slog.Warn("Skipping unsupported zip entry", "type", f.Mode().Type().String(), "name", f.Name)
+	}
+	return nil
+}
+
+// extractError lists the entries of an archive that could not be written
+type extractError struct {
+	archive string
+	names   []string
+	errs    []error
+}
+
+func (e *extractError) add(name string, err error) {
+	e.names = append(e.names, name)
+	e.errs = append(e.errs, err)
+}
+
+// err returns e if any entry failed, nil otherwise
+func (e *extractError) err() error {
+	if len(e.names) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *extractError) Error() string {
+	return fmt.Sprintf("%d of the entries in %s could not be extracted: %s", len(e.names), e.archive, strings.Join(e.names, ", "))
+}
+
+func (e *extractError) Unwrap() []error {
+	return e.errs
+}
+
+// unzipFile writes one zip entry to target, counting the bytes through counter
+func unzipFile(f *zip.File, target string, mode os.FileMode, rec *entryRecorder, counter *countingReader) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	counter.r = rc
+	if err := rec.copy(target, outFile, counter); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
+
+// readZipFile returns the contents of a small entry such as a symlink target
+func readZipFile(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	return string(data), err
+}
+
+// countingReader reports how much of the underlying reader has been consumed
+type countingReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress func(read int64, total int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.progress != nil {
+		c.progress(c.read, c.total)
+	}
+	return n, err
+}
+
+// hasGzipMagic sniffs the first two bytes of r for the gzip header and
+// rewinds it so the whole stream can be read afterwards
+func hasGzipMagic(r io.ReadSeeker) (bool, error) {
+	magic := make([]byte, 2)
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	return n == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// hasZipMagic reports whether the file at path starts with a zip local file
+// header, or the end of central directory record of an empty zip
+func hasZipMagic(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+
+	return n == 4 && (bytes.Equal(magic, []byte("PK\x03\x04")) || bytes.Equal(magic, []byte("PK\x05\x06"))), nil
+}
+
+// safeJoin resolves an archive entry name inside dest, rejecting absolute
+// names and ".." segments that would place the entry outside of it
+func safeJoin(dest string, name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("illegal absolute path in archive: %s", name)
+	}
+
+	target := filepath.Join(dest, name)
+	if !within(dest, target) {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+
+	return target, nil
+}
+
+// safeLink checks that a symlink at target pointing to linkname resolves
+// inside dest. Relative link names are followed from the link's own directory
+// as the system would, through links already on disk, so a chain of links
+// that each look harmless cannot lead out of dest.
+func safeLink(dest string, target string, linkname string) error {
+	if filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" {
+		return fmt.Errorf("illegal absolute symlink in archive: %s -> %s", target, linkname)
+	}
+
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	path, err := resolvePath(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			path = filepath.Dir(path)
+		default:
+			path = filepath.Join(path, part)
+			if resolved, err := filepath.EvalSymlinks(path); err == nil {
+				path = resolved
+			}
+		}
+		if !within(root, path) {
+			return fmt.Errorf("illegal symlink in archive: %s -> %s", target, linkname)
+		}
+	}
+
+	return nil
+}
+
+// checkParent makes sure the directory an entry is written to is inside dest
+// once the symlinks on disk are followed. safeJoin only looks at the name, so
+// without this an earlier link entry could redirect the write.
+func checkParent(dest string, target string) error {
+	return checkInside(dest, filepath.Dir(target), target)
+}
+
+// checkInside makes sure path, with its symlinks followed as far as it
+// exists, is inside dest. name identifies the entry in the error.
+func checkInside(dest string, path string, name string) error {
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	if !within(root, resolved) {
+		return fmt.Errorf("illegal path through symlink in archive: %s", name)
+	}
+	return nil
+}
+
+// resolvePath follows the symlinks in the part of path that exists and
+// appends the rest unchanged. path must already be clean.
+func resolvePath(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(append([]string{path}, rest...)...), nil
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// within reports whether path is root or inside it
+func within(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeSymlink deletes a link at path so a regular file is written in its
+// place rather than through it
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// replaceWith removes whatever is at path so create can make a new link there
+func replaceWith(path string, create func() error) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return create()
+}
@@ -0,0 +1,511 @@
+package patch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// tarEntry is one entry of an archive built by a test. Regular files are the
+// default type and get mode 0644 unless one is given.
+type tarEntry struct {
+	name     string
+	body     string
+	typeflag byte
+	linkname string
+	mode     int64
+}
+
+// tarGz returns a gzipped tar archive holding entries, in order
+func tarGz(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     entry.mode,
+		}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.body))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipArchive returns a zip archive holding entries. Symlinks store their
+// target as the body, as zip tools do.
+func zipArchive(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		mode := os.FileMode(entry.mode)
+		if mode == 0 {
+			mode = 0644
+		}
+		body := entry.body
+		switch entry.typeflag {
+		case tar.TypeDir:
+			header.Name += "/"
+			mode |= os.ModeDir
+		case tar.TypeSymlink:
+			mode |= os.ModeSymlink
+			body = entry.linkname
+		}
+		header.SetMode(mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extractDirs returns an empty destination inside a fresh directory, so tests
+// can check nothing was written next to it
+func extractDirs(t *testing.T) (parent string, dest string) {
+	t.Helper()
+	parent = t.TempDir()
+	dest = filepath.Join(parent, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return parent, dest
+}
+
+// writeArchive saves data as name in dir and returns its path
+func writeArchive(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// rejected returns the entry names an extraction error lists
+func rejected(t *testing.T, err error) []string {
+	t.Helper()
+	var extractErr *extractError
+	if !errors.As(err, &extractErr) {
+		t.Fatalf("got error %v, want an extractError", err)
+	}
+	return extractErr.names
+}
+
+func TestUntarSymlinkInsideDest(t *testing.T) {
+	parent, dest := extractDirs(t)
+	archive := writeArchive(t, parent, "p.tar.gz", tarGz(t,
+		tarEntry{name: "d/", typeflag: tar.TypeDir, mode: 0755},
+		tarEntry{name: "d/a.txt", body: "hello"},
+		tarEntry{name: "link", typeflag: tar.TypeSymlink, linkname: "d/a.txt"},
+		tarEntry{name: "d/up", typeflag: tar.TypeSymlink, linkname: "../d/a.txt"},
+	))
+
+	if err := untarGz(archive, dest, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"link", "d/up"} {
+		data, err := os.ReadFile(filepath.Join(dest, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Errorf("%s reads %q, want %q", link, data, "hello")
+		}
+	}
+}
+
+func TestUntarRejectsSymlinksOutsideDest(t *testing.T) {
+	parent, dest := extractDirs(t)
+	archive := writeArchive(t, parent, "p.tar.gz", tarGz(t,
+		tarEntry{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		tarEntry{name: "up", typeflag: tar.TypeSymlink, linkname: "../outside"},
+		tarEntry{name: "ok.txt", body: "kept"},
+	))
+
+	names := rejected(t, untarGz(archive, dest, nil, nil, nil))
+	if len(names) != 2 || names[0] != "passwd" || names[1] != "up" {
+		t.Errorf("rejected %v, want [passwd up]", names)
+	}
+	for _, link := range []string{"passwd", "up"} {
+		if _, err := os.Lstat(filepath.Join(dest, link)); !os.IsNotExist(err) {
+			t.Errorf("%s was created: %v", link, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "ok.txt")); err != nil {
+		t.Errorf("valid entry not extracted: %v", err)
+	}
+}
+
+func TestUntarRejectsChainedSymlinks(t *testing.T) {
+	parent, dest := extractDirs(t)
+	// Each link looks inside dest on its own, but x/y is dest itself so
+	// x/y/z would be its parent
+	archive := writeArchive(t, parent, "p.tar.gz", tarGz(t,
+		tarEntry{name: "x/", typeflag: tar.TypeDir, mode: 0755},
+		tarEntry{name: "x/y", typeflag: tar.TypeSymlink, linkname: ".."},
+		tarEntry{name: "x/y/z", typeflag: tar.TypeSymlink, linkname: ".."},
+		tarEntry{name: "x/y/z/evil.txt", body: "escaped"},
+	))
+
+	if err := untarGz(archive, dest, nil, nil, nil); err == nil {
+		t.Error("extraction succeeded, want the chained link rejected")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("evil.txt was written outside dest: %v", err)
+	}
+}
+
+func TestUntarRejectsWritesThroughEscapedLink(t *testing.T) {
+	parent, dest := extractDirs(t)
+	if err := os.WriteFile(filepath.Join(parent, "outside.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a points at n/.. while n does not exist; once n is made a link to dest,
+	// a leads to its parent
+	archive := writeArchive(t, parent, "p.tar.gz", tarGz(t,
+		tarEntry{name: "a", typeflag: tar.TypeSymlink, linkname: "n/.."},
+		tarEntry{name: "n", typeflag: tar.TypeSymlink, linkname: "."},
+		tarEntry{name: "a/evil.txt", body: "escaped"},
+		tarEntry{name: "h", typeflag: tar.TypeLink, linkname: "a/outside.txt"},
+	))
+
+	names := rejected(t, untarGz(archive, dest, nil, nil, nil))
+	if len(names) != 2 || names[0] != "a/evil.txt" || names[1] != "h" {
+		t.Errorf("rejected %v, want [a/evil.txt h]", names)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("evil.txt was written outside dest: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "h")); !os.IsNotExist(err) {
+		t.Errorf("hardlink to a file outside dest was created: %v", err)
+	}
+}
+
+func TestUntarReplacesSymlinkWithFile(t *testing.T) {
+	parent, dest := extractDirs(t)
+	outside := filepath.Join(parent, "outside.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "f.txt")); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeArchive(t, parent, "p.tar.gz", tarGz(t, tarEntry{name: "f.txt", body: "new"}))
+
+	if err := untarGz(archive, dest, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "secret" {
+		t.Errorf("file outside dest was overwritten with %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "f.txt")); string(data) != "new" {
+		t.Errorf("f.txt = %q, want %q", data, "new")
+	}
+}
+
+func TestUnzipNestedDirectories(t *testing.T) {
+	parent, dest := extractDirs(t)
+	archive := zipArchive(t,
+		tarEntry{name: "top.txt", body: "top"},
+		tarEntry{name: "Data/", typeflag: tar.TypeDir},
+		tarEntry{name: "Data/enUS/patch.txt", body: "nested"},
+		// No directory entries for these, as some zip tools write them
+		tarEntry{name: "Interface/AddOns/Araxia/Araxia.toc", body: "deep"},
+	)
+	archived, err := extract(writeArchive(t, parent, "p.zip", archive), dest, nil, nil, nil)
+	if err != nil || !archived {
+		t.Fatalf("extract = %v, %v", archived, err)
+	}
+	for name, want := range map[string]string{
+		"top.txt":                            "top",
+		"Data/enUS/patch.txt":                "nested",
+		"Interface/AddOns/Araxia/Araxia.toc": "deep",
+	} {
+		if got := readFile(t, dest, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dest, "Data", "enUS")); err != nil || !info.IsDir() {
+		t.Errorf("Data/enUS is not a directory: %v", err)
+	}
+}
+
+func TestRunExtractsZipArchives(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.zip": zipArchive(t, tarEntry{name: "Data/a.txt", body: "from the zip"}),
+	})
+	config := testConfig(t, server.URL)
+	result, _ := runPatcher(t, config, "p.zip")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "Data/a.txt"); got != "from the zip" {
+		t.Errorf("Data/a.txt = %q", got)
+	}
+	if exists(config.Directory, "p.zip") {
+		t.Error("extracted p.zip was kept")
+	}
+}
+
+func TestUnzipRejectsSymlinksOutsideDest(t *testing.T) {
+	parent, dest := extractDirs(t)
+	archive := writeArchive(t, parent, "p.zip", zipArchive(t,
+		tarEntry{name: "x", typeflag: tar.TypeDir, mode: 0755},
+		tarEntry{name: "x/y", typeflag: tar.TypeSymlink, linkname: ".."},
+		tarEntry{name: "x/y/z", typeflag: tar.TypeSymlink, linkname: ".."},
+		tarEntry{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		tarEntry{name: "x/y/z/evil.txt", body: "escaped"},
+	))
+
+	// Without x/y/z, x/y/z/evil.txt is dest/z/evil.txt
+	names := rejected(t, unzip(archive, dest, nil, nil, nil))
+	if len(names) != 2 || names[0] != "x/y/z" || names[1] != "passwd" {
+		t.Errorf("rejected %v, want [x/y/z passwd]", names)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("evil.txt was written outside dest: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "x/y")); err != nil || target != ".." {
+		t.Errorf("valid link x/y = %q, %v", target, err)
+	}
+}
+
+func TestExtractRejectsPathTraversal(t *testing.T) {
+	entries := []tarEntry{
+		{name: "../evil.txt", body: "escaped"},
+		{name: "d/../../evil.txt", body: "escaped"},
+		{name: "/abs.txt", body: "absolute"},
+		{name: "d/../inside.txt", body: "kept"},
+	}
+	for name, archive := range map[string][]byte{"p.tar.gz": tarGz(t, entries...), "p.zip": zipArchive(t, entries...)} {
+		parent, dest := extractDirs(t)
+		path := writeArchive(t, parent, name, archive)
+
+		_, err := extract(path, dest, nil, nil, nil)
+		names := rejected(t, err)
+		if len(names) != 3 || names[0] != "../evil.txt" || names[1] != "d/../../evil.txt" || names[2] != "/abs.txt" {
+			t.Errorf("%s: rejected %v, want the three escaping entries", name, names)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "evil.txt")); !os.IsNotExist(err) {
+			t.Errorf("%s: evil.txt was written outside dest: %v", name, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dest, "inside.txt")); err != nil || string(data) != "kept" {
+			t.Errorf("%s: inside.txt = %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "dest")
+	for _, name := range []string{"a.txt", "d/e/f.txt", "d/../a.txt", "./a.txt", "a..b.txt"} {
+		if _, err := safeJoin(dest, name); err != nil {
+			t.Errorf("safeJoin(%q) = %v, want it inside dest", name, err)
+		}
+	}
+	for _, name := range []string{"..", "../a.txt", "d/../../a.txt", "/etc/passwd", `\windows`} {
+		if target, err := safeJoin(dest, name); err == nil {
+			t.Errorf("safeJoin(%q) = %s, want it rejected", name, target)
+		}
+	}
+}
+
+func TestExtractKeepsModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not kept on Windows")
+	}
+	entries := []tarEntry{
+		{name: "private/", typeflag: tar.TypeDir, mode: 0700},
+		{name: "private/key", body: "secret", mode: 0600},
+		{name: "run.sh", body: "#!/bin/sh", mode: 0755},
+		{name: "readonly.txt", body: "ro", mode: 0444},
+	}
+	for name, archive := range map[string][]byte{"p.tar.gz": tarGz(t, entries...), "p.zip": zipArchive(t, entries...)} {
+		parent, dest := extractDirs(t)
+		if _, err := extract(writeArchive(t, parent, name, archive), dest, nil, nil, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		mode := func(path string) os.FileMode {
+			info, err := os.Stat(filepath.Join(dest, path))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return info.Mode().Perm()
+		}
+		// The umask may take bits away but never adds any
+		if got := mode("private"); got&0077 != 0 || got&0700 != 0700 {
+			t.Errorf("%s: private/ has mode %v, want 0700", name, got)
+		}
+		if got := mode("private/key"); got&0077 != 0 {
+			t.Errorf("%s: private/key has mode %v, want it kept from others", name, got)
+		}
+		if got := mode("run.sh"); got&0100 == 0 {
+			t.Errorf("%s: run.sh has mode %v, want it executable", name, got)
+		}
+		// A later patch must be able to replace it
+		if got := mode("readonly.txt"); got&0200 == 0 {
+			t.Errorf("%s: readonly.txt has mode %v, want the owner to keep write access", name, got)
+		}
+	}
+}
+
+func TestExtractDetectsFormatByContents(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		// Written by the archive, empty for files that are not one
+		extracted string
+	}{
+		{"renamed.bin", tarGz(t, tarEntry{name: "from-tar.txt", body: "tar"}), "from-tar.txt"},
+		{"renamed.dat", zipArchive(t, tarEntry{name: "from-zip.txt", body: "zip"}), "from-zip.txt"},
+		{"fake.tar.gz", []byte("MPQ\x1a only named like an archive"), ""},
+		{"fake.zip", []byte("P"), ""},
+		{"empty.tar.gz", nil, ""},
+	}
+	for _, test := range tests {
+		parent, dest := extractDirs(t)
+		path := writeArchive(t, parent, test.name, test.data)
+		archive, err := extract(path, dest, nil, nil, nil)
+		if err != nil || archive != (test.extracted != "") {
+			t.Errorf("extract(%s) = %v, %v, want %v", test.name, archive, err, test.extracted != "")
+		}
+		if data, _ := os.ReadFile(path); !bytes.Equal(data, test.data) {
+			t.Errorf("%s was changed by extracting it", test.name)
+		}
+		if test.extracted != "" && !exists(dest, test.extracted) {
+			t.Errorf("%s did not extract %s", test.name, test.extracted)
+		}
+	}
+}
+
+func TestExtractReportsProgress(t *testing.T) {
+	var entries []tarEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, tarEntry{name: fmt.Sprintf("f%d.bin", i), body: string(testData(100000 + i))})
+	}
+	for name, archive := range map[string][]byte{"p.tar.gz": tarGz(t, entries...), "p.zip": zipArchive(t, entries...)} {
+		parent, dest := extractDirs(t)
+		var reports [][2]int64
+		progress := func(read int64, total int64) { reports = append(reports, [2]int64{read, total}) }
+		if _, err := extract(writeArchive(t, parent, name, archive), dest, nil, nil, progress); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(reports) < 2 {
+			t.Fatalf("%s: %d progress reports, want them throughout", name, len(reports))
+		}
+		for i := 1; i < len(reports); i++ {
+			if reports[i][0] < reports[i-1][0] {
+				t.Fatalf("%s: progress went back from %d to %d", name, reports[i-1][0], reports[i][0])
+			}
+		}
+		if last := reports[len(reports)-1]; last[0] != last[1] || last[1] <= 0 {
+			t.Errorf("%s: progress ends at %d of %d, want all of it", name, last[0], last[1])
+		}
+	}
+}
+
+func TestExtractProgressIsThrottled(t *testing.T) {
+	saved := uiUpdateInterval
+	uiUpdateInterval = time.Hour
+	t.Cleanup(func() { uiUpdateInterval = saved })
+	progress := newTestProgress()
+	p := New(context.Background(), http.DefaultClient, Config{}, Manifest{Files: []string{"p.tar.gz"}}, progress)
+	report := p.extractProgress(1)
+	for read := int64(1); read <= 1000; read++ {
+		report(read, 1000)
+	}
+	// Only the first read and the last, as the rest arrive within the interval
+	if got := progress.current[1]; len(got) != 2 || got[0] != 1 || got[1] != 1000 {
+		t.Errorf("reported %v, want [1 1000]", got)
+	}
+}
+
+func TestExtractContinuesPastUnwritableEntries(t *testing.T) {
+	entries := []tarEntry{
+		{name: "before.txt", body: "before"},
+		// Its parent is a file, which cannot be written into even as root
+		{name: "blocker/inside.txt", body: "unwritable"},
+		{name: "data/after.txt", body: "after"},
+	}
+	for name, archive := range map[string][]byte{"p.tar.gz": tarGz(t, entries...), "p.zip": zipArchive(t, entries...)} {
+		parent, dest := extractDirs(t)
+		if err := os.WriteFile(filepath.Join(dest, "blocker"), []byte("a file"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := extract(writeArchive(t, parent, name, archive), dest, nil, nil, nil)
+		if got := rejected(t, err); len(got) != 1 || got[0] != "blocker/inside.txt" {
+			t.Errorf("%s: rejected %q, want only blocker/inside.txt", name, got)
+		}
+		for _, entry := range []string{"before.txt", "data/after.txt"} {
+			if !exists(dest, entry) {
+				t.Errorf("%s: %s not extracted past the failed entry", name, entry)
+			}
+		}
+	}
+}
+
+func TestRunReportsExtractionErrors(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"bad.tar.gz":  tarGz(t, tarEntry{name: "ok.txt", body: "ok"}, tarEntry{name: "../escape.txt", body: "no"}),
+		"good.tar.gz": tarGz(t, tarEntry{name: "good.txt", body: "good"}),
+	})
+	config := testConfig(t, server.URL)
+
+	result, progress := runPatcher(t, config, "bad.tar.gz", "good.tar.gz")
+	if result.Success {
+		t.Fatal("patch succeeded with an entry that could not be extracted")
+	}
+	failed := result.Failures()
+	if len(failed) != 1 || failed[0].File != "bad.tar.gz" || !strings.Contains(failed[0].Error, "../escape.txt") {
+		t.Errorf("failures %+v, want bad.tar.gz naming its entry", failed)
+	}
+	if reason := progress.reasons[1]; reason != i18n.Tr("failed.extraction") {
+		t.Errorf("bad.tar.gz shown as %q, want %q", reason, i18n.Tr("failed.extraction"))
+	}
+	if _, ok := progress.failed[2]; ok || !exists(config.Directory, "good.txt") {
+		t.Errorf("good.tar.gz failed along with bad.tar.gz: %v", progress.failed[2])
+	}
+}
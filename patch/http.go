@@ -0,0 +1,248 @@
+package patch
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Redirects followed before a request is given up on
+var maxRedirects = 5
+
+// A request fails when the server sends no response headers for this long, so
+// a server that accepts the connection but never answers cannot hang the
+// patcher. Downloads retry it like a stall.
+var responseHeaderTimeout = 30 * time.Second
+
+// NewClient builds the client every patch request goes through. Without an
+// explicit proxy the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables
+// are honoured; user info in the proxy URL is sent as basic auth.
+func NewClient(proxy *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
+
+// checkRedirect follows up to maxRedirects hops. The Range header of a resumed
+// download is carried over to each new request by the client.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects from %s", maxRedirects, via[0].URL)
+	}
+	slog.Debug("Following redirect", "from", via[len(via)-1].URL.String(), "to", req.URL.String())
+	return nil
+}
+
+// Fetch downloads a small metadata file such as the manifest from the first
+// of sources that can provide it. The caller closes the response body.
+func Fetch(ctx context.Context, client *http.Client, sources []string, name string) (*http.Response, error) {
+	var lastErr error
+	for _, source := range sources {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+		} else if resp.StatusCode != http.StatusOK {
+			lastErr = newStatusError(resp)
+		} else {
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, lastErr
+		}
+		slog.Warn("Fetch failed", "name", name, "source", source, "err", lastErr)
+	}
+
+	return nil, lastErr
+}
+
+// requestFile starts the download of file, asking only for the bytes after
+// offset when a partial copy is already on disk. A partial that the server
+// says is out of range is larger than the file and is downloaded again in full.
+func requestFile(ctx context.Context, client *http.Client, source string, file string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+file, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Requested file", "url", req.URL.String(), "offset", offset, "status", resp.Status, "length", resp.ContentLength)
+
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		slog.Warn("Partial file is larger than the download, restarting", "file", file)
+		resp.Body.Close()
+		return requestFile(ctx, client, source, file, 0)
+	}
+
+	// Anything else is an error page, not the file
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+// requestRange fetches bytes start to end (inclusive) of file. Unlike
+// requestFile only a 206 is accepted, since anything else would not be the
+// requested part.
+func requestRange(ctx context.Context, client *http.Client, source string, file string, start int64, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+file, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Requested range", "url", req.URL.String(), "start", start, "end", end, "status", resp.Status)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		if resp.StatusCode == http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("server ignored the range request for %s", file)
+		}
+		return nil, newStatusError(resp)
+	}
+	return resp, nil
+}
+
+// headSize asks source for the size of file without downloading it
+func headSize(ctx context.Context, client *http.Client, source string, file string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source+file, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, newStatusError(resp)
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+// headSizeFrom asks each of sources in turn for the size of file until one
+// answers
+func headSizeFrom(ctx context.Context, client *http.Client, sources []string, file string) (int64, error) {
+	var lastErr error
+	for _, source := range sources {
+		size, err := headSize(ctx, client, source, file)
+		if err == nil {
+			return size, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Debug("Size request failed", "file", file, "source", source, "err", err)
+	}
+	return -1, lastErr
+}
+
+// downloadError reports why a request was cut short when its context was
+// cancelled, so a stall reads as such rather than as a plain cancellation
+func downloadError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// statusError is returned when the server answers with something other than the file
+type statusError struct {
+	status string
+	code   int
+	url    string
+	// The signed patch URL is no longer valid, only a new launcher will fix it
+	expired bool
+}
+
+// newStatusError describes an error response and closes its body. Google
+// Cloud Storage answers an expired signed URL with 400 or 403 and an XML body
+// naming the problem, which is sniffed so the player is told what to do.
+func newStatusError(resp *http.Response) *statusError {
+	defer resp.Body.Close()
+
+	e := &statusError{status: resp.Status, code: resp.StatusCode, url: resp.Request.URL.String()}
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		e.expired = strings.Contains(string(body), "<Code>ExpiredToken</Code>") ||
+			strings.Contains(string(body), "Request has expired")
+	}
+	return e
+}
+
+func (e *statusError) Error() string {
+	if e.expired {
+		return fmt.Sprintf("patch URL expired, please update the launcher (%s from %s)", e.status, e.url)
+	}
+	return fmt.Sprintf("unexpected status %s from %s", e.status, e.url)
+}
+
+// temporary reports whether the status is worth retrying
+func (e *statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// contentRangeTotal returns the full file size of a 206 response from its
+// Content-Range header, falling back to the length of the remaining bytes
+func contentRangeTotal(resp *http.Response, offset int64) int64 {
+	var start, end, total int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	if err == nil {
+		return total
+	}
+	if resp.ContentLength < 0 {
+		return -1
+	}
+	return offset + resp.ContentLength
+}
+
+// openOutput opens the download target for writing. With a non-zero offset the
+// existing bytes are fed to the hasher and new data is appended after them,
+// otherwise the file is truncated.
+func openOutput(path string, offset int64, hasher hash.Hash) (*os.File, error) {
+	if offset == 0 {
+		return os.Create(path)
+	}
+
+	out, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(hasher, out, offset); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,428 @@
+package patch
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// quickHeaderTimeout makes requests give up on silent servers quickly for the
+// rest of the test
+func quickHeaderTimeout(t *testing.T) {
+	t.Helper()
+	saved := responseHeaderTimeout
+	responseHeaderTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { responseHeaderTimeout = saved })
+}
+
+// serveSilent accepts requests and never answers them
+func serveSilent(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchGivesUpOnSilentSource(t *testing.T) {
+	quickHeaderTimeout(t)
+	silent := serveSilent(t)
+	mirror := serveFiles(t, map[string][]byte{"manifest": []byte("a.bin\n")})
+	client := NewClient(nil)
+
+	start := time.Now()
+	resp, err := Fetch(context.Background(), client, []string{silent.URL + "/", mirror.URL + "/"}, "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "a.bin\n" {
+		t.Errorf("body = %q, want the mirror's manifest", body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Fetch took %v with a silent source", elapsed)
+	}
+
+	if _, err := headSize(context.Background(), client, silent.URL+"/", "a.bin"); err == nil {
+		t.Error("HEAD to a silent source succeeded")
+	}
+}
+
+func TestRunRetriesSilentServer(t *testing.T) {
+	quickHeaderTimeout(t)
+	fastRetries(t)
+	// The first GET of the file goes unanswered, as from an overloaded server
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		silent := false
+		if r.Method == http.MethodGet {
+			once.Do(func() { silent = true })
+		}
+		if silent {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+
+	progress := newTestProgress()
+	result := New(context.Background(), NewClient(nil), config, Manifest{Files: []string{"a.bin"}}, progress).Run()
+	if result == nil || !result.Success {
+		t.Fatalf("patch failed: %+v %v", result, progress.errors)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != "contents" {
+		t.Errorf("a.bin = %q", got)
+	}
+}
+
+func TestRunRejectsErrorPages(t *testing.T) {
+	fastRetries(t)
+	var mu sync.Mutex
+	gets := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets[r.URL.Path]++
+			mu.Unlock()
+		}
+		switch r.URL.Path {
+		case "/missing.bin":
+			http.Error(w, "<html>not here</html>", http.StatusNotFound)
+		case "/busy.bin":
+			http.Error(w, "<html>try later</html>", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+
+	result, progress := runPatcher(t, config, "missing.bin", "busy.bin")
+	if result.Success {
+		t.Fatal("patch succeeded with error pages for files")
+	}
+	for i, file := range []string{"missing.bin", "busy.bin"} {
+		var statusErr *statusError
+		if !errors.As(progress.failed[i+1], &statusErr) {
+			t.Errorf("%s failed with %v, want a statusError", file, progress.failed[i+1])
+		}
+		if exists(config.Directory, file) || exists(config.Directory, file+partSuffix) {
+			t.Errorf("error page for %s was written", file)
+		}
+	}
+	// A missing file will not appear by asking again, a server error might go away
+	if gets["/missing.bin"] != 1 {
+		t.Errorf("missing.bin fetched %d times, want once", gets["/missing.bin"])
+	}
+	if gets["/busy.bin"] != downloadRetries+1 {
+		t.Errorf("busy.bin fetched %d times, want %d", gets["/busy.bin"], downloadRetries+1)
+	}
+}
+
+func TestRunFallsBackToMirrors(t *testing.T) {
+	fastRetries(t)
+	files := map[string][]byte{"a.bin": []byte("from the mirror"), "b.bin": []byte("b")}
+	// The source only has b.bin, the first mirror is down
+	source := serveFiles(t, map[string][]byte{"b.bin": files["b.bin"]})
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	mirror, mirrorGets := serveGets(t, files)
+	config := testConfig(t, source.URL)
+	config.Mirrors = []string{down.URL + "/", mirror.URL + "/"}
+
+	result, progress := runPatcher(t, config, "a.bin", "b.bin")
+	if !result.Success {
+		t.Fatalf("patch failed with a working mirror: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != "from the mirror" {
+		t.Errorf("a.bin = %q", got)
+	}
+	if mirrorGets("a.bin") != 1 {
+		t.Errorf("a.bin fetched %d times from the mirror, want once", mirrorGets("a.bin"))
+	}
+	if mirrorGets("b.bin") != 0 {
+		t.Errorf("b.bin fetched %d times from the mirror, want only from the source", mirrorGets("b.bin"))
+	}
+	for i, want := range []string{i18n.Tr("status.mirror", 1, 2), i18n.Tr("status.mirror", 2, 2)} {
+		if !slices.Contains(progress.statuses[1], want) {
+			t.Errorf("a.bin statuses %q, want mirror %d shown", progress.statuses[1], i+1)
+		}
+	}
+}
+
+func TestFetchManifestFromMirror(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	mirror := serveFiles(t, map[string][]byte{manifestFile: []byte("version v2\na.bin\n")})
+
+	manifest, err := FetchManifest(context.Background(), http.DefaultClient, []string{down.URL + "/", mirror.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != "v2" || len(manifest.Files) != 1 || manifest.Files[0] != "a.bin" {
+		t.Errorf("manifest from the mirror = %+v", manifest)
+	}
+}
+
+// memoryTransport answers requests from files without any network, as a
+// caller of New might to test its own integration
+type memoryTransport struct {
+	files    map[string]string
+	mu       sync.Mutex
+	requests []string
+}
+
+func (m *memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	m.requests = append(m.requests, req.Method+" "+req.URL.String())
+	m.mu.Unlock()
+	rec := httptest.NewRecorder()
+	data, ok := m.files[req.URL.Path[1:]]
+	if !ok {
+		http.NotFound(rec, req)
+	} else {
+		http.ServeContent(rec, req, req.URL.Path, time.Time{}, strings.NewReader(data))
+	}
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func TestRunUsesInjectedClient(t *testing.T) {
+	transport := &memoryTransport{files: map[string]string{"a.bin": "in memory", "b.tar.gz": string(tarGz(t, tarEntry{name: "b.txt", body: "b"}))}}
+	client := &http.Client{Transport: transport}
+	config := Config{Directory: t.TempDir(), Source: "http://patches.invalid/"}
+
+	progress := newTestProgress()
+	result := New(context.Background(), client, config, Manifest{Files: []string{"a.bin", "b.tar.gz"}}, progress).Run()
+	if result == nil || !result.Success {
+		t.Fatalf("patch through the injected client failed: %+v %v", result, progress.errors)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != "in memory" {
+		t.Errorf("a.bin = %q", got)
+	}
+	if got := readFile(t, config.Directory, "b.txt"); got != "b" {
+		t.Errorf("b.txt = %q", got)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if !slices.Contains(transport.requests, "GET http://patches.invalid/a.bin") {
+		t.Errorf("requests %q, want a.bin fetched through the client", transport.requests)
+	}
+}
+
+func TestNewClientUsesProxy(t *testing.T) {
+	// Plain HTTP through a proxy asks it for the absolute URL
+	var mu sync.Mutex
+	var seen []string
+	var auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.String())
+		auth = r.Header.Get("Proxy-Authorization")
+		mu.Unlock()
+		w.Write([]byte("a.bin\n"))
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("player", "secret")
+
+	manifest, err := FetchManifest(context.Background(), NewClient(proxyURL), []string{"http://patches.invalid/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0] != "a.bin" {
+		t.Errorf("manifest through the proxy = %+v", manifest)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0] != "http://patches.invalid/"+manifestFile {
+		t.Errorf("proxy was asked for %q", seen)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("player:secret")); auth != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", auth, want)
+	}
+}
+
+func TestRunFollowsRedirects(t *testing.T) {
+	a := []byte(strings.Repeat("patch data ", 1000))
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.bin":
+			http.Redirect(w, r, "/signed/a.bin?token=1", http.StatusFound)
+		case "/signed/a.bin":
+			if r.Method == http.MethodGet {
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(string(a)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+	// Half of the file from an earlier run, resumed through the redirect
+	if err := os.WriteFile(filepath.Join(config.Directory, "a.bin"+partSuffix), a[:len(a)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := newTestProgress()
+	result := New(context.Background(), NewClient(nil), config, Manifest{Files: []string{"a.bin"}}, progress).Run()
+	if result == nil || !result.Success {
+		t.Fatalf("patch failed through a redirect: %+v %v", result, progress.failed)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != string(a) {
+		t.Errorf("a.bin has %d bytes, want %d", len(got), len(a))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := fmt.Sprintf("bytes=%d-", len(a)/2); len(ranges) != 1 || ranges[0] != want {
+		t.Errorf("redirected requests asked for %q, want %q", ranges, want)
+	}
+}
+
+func TestRunStopsRedirectLoops(t *testing.T) {
+	fastRetries(t)
+	var hops atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/a.bin" {
+			hops.Add(1)
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+	saved := downloadRetries
+	downloadRetries = 0
+	t.Cleanup(func() { downloadRetries = saved })
+
+	progress := newTestProgress()
+	result := New(context.Background(), NewClient(nil), config, Manifest{Files: []string{"a.bin"}}, progress).Run()
+	if result == nil || result.Success {
+		t.Fatalf("patch succeeded through a redirect loop: %+v", result)
+	}
+	if !strings.Contains(result.Files[0].Error, fmt.Sprintf("stopped after %d redirects", maxRedirects)) {
+		t.Errorf("a.bin failed with %q, want the redirect limit", result.Files[0].Error)
+	}
+	// Counted as net/http counts them, the first request included
+	if got := hops.Load(); got != int32(maxRedirects) {
+		t.Errorf("sent %d requests, want %d", got, maxRedirects)
+	}
+}
+
+func TestRunReportsExpiredURL(t *testing.T) {
+	fastRetries(t)
+	bodies := map[string]struct {
+		code int
+		body string
+	}{
+		"/token.bin":  {http.StatusForbidden, "<?xml version='1.0' encoding='UTF-8'?><Error><Code>ExpiredToken</Code><Message>The provided token has expired.</Message></Error>"},
+		"/signed.bin": {http.StatusBadRequest, "<?xml version='1.0' encoding='UTF-8'?><Error><Code>InvalidArgument</Code><Details>Request has expired: 1700000000</Details></Error>"},
+		"/denied.bin": {http.StatusForbidden, "<?xml version='1.0' encoding='UTF-8'?><Error><Code>AccessDenied</Code></Error>"},
+	}
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(response.code)
+		io.WriteString(w, response.body)
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+
+	result, _ := runPatcher(t, config, "token.bin", "signed.bin", "denied.bin")
+	if result.Success {
+		t.Fatal("patch succeeded with expired URLs")
+	}
+	for i, expired := range []bool{true, true, false} {
+		file := result.Files[i]
+		if got := strings.Contains(file.Error, "patch URL expired, please update the launcher"); got != expired {
+			t.Errorf("%s failed with %q, expired = %v, want %v", file.File, file.Error, got, expired)
+		}
+		if exists(config.Directory, file.File) || exists(config.Directory, file.File+partSuffix) {
+			t.Errorf("error body for %s was written", file.File)
+		}
+	}
+	// Asking again will not make the URL valid
+	if got := gets.Load(); got != 3 {
+		t.Errorf("%d GET requests, want one per file", got)
+	}
+}
+
+func TestRunRestartsOversizedPartial(t *testing.T) {
+	files := map[string][]byte{"a.bin": []byte(strings.Repeat("new ", 25))}
+	files["checksums.txt"] = checksumList(files, "a.bin")
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/a.bin" && r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		// Answers a range past the end with 416
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(string(data)))
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+	// Left by a run against an older, larger a.bin
+	stale := strings.Repeat("old ", 50)
+	if err := os.WriteFile(filepath.Join(config.Directory, "a.bin"+partSuffix), []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, _ := runPatcher(t, config, "a.bin")
+	if !result.Success || result.Files[0].Unverified {
+		t.Fatalf("patch = %+v, want a.bin downloaded again and verified", result.Files)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != string(files["a.bin"]) {
+		t.Errorf("a.bin = %q", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{fmt.Sprintf("bytes=%d-", len(stale)), ""}
+	if len(ranges) != 2 || ranges[0] != want[0] || ranges[1] != want[1] {
+		t.Errorf("requests asked for %q, want %q", ranges, want)
+	}
+}
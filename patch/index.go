@@ -0,0 +1,222 @@
+package patch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// Written to the install directory after each run, listing the files every
+// manifest entry put there and their checksums, so a repair can tell which
+// ones are missing or damaged without downloading anything
+var indexFile = "patch-index.json"
+
+// installIndex maps each manifest file to the files it installed. Streamed
+// archives record their entries from the download goroutines.
+type installIndex struct {
+	mu    sync.Mutex
+	Files map[string][]indexEntry `json:"files"`
+}
+
+// indexEntry is one installed file, relative to the install directory with
+// forward slashes
+type indexEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// loadIndex reads the index of directory. A missing or unreadable index is
+// empty, which only means a repair cannot vouch for any file.
+func loadIndex(directory string) *installIndex {
+	index := &installIndex{Files: make(map[string][]indexEntry)}
+	data, err := os.ReadFile(directory + "/" + indexFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Unable to read install index", "directory", directory, "err", err)
+		}
+		return index
+	}
+	if err := json.Unmarshal(data, index); err != nil || index.Files == nil {
+		slog.Warn("Ignoring invalid install index", "directory", directory, "err", err)
+		return &installIndex{Files: make(map[string][]indexEntry)}
+	}
+	return index
+}
+
+// save writes the index to directory
+func (x *installIndex) save(directory string) error {
+	x.mu.Lock()
+	data, err := json.Marshal(x)
+	x.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(directory+"/"+indexFile, data, 0644)
+}
+
+// set records the files installed by file, replacing what it installed before
+func (x *installIndex) set(file string, entries []indexEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.Files[file] = entries
+}
+
+// forget drops file, whose installed files are no longer known
+func (x *installIndex) forget(file string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.Files, file)
+}
+
+// entries returns the files installed by file, and false if it is not indexed
+func (x *installIndex) entries(file string) ([]indexEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries, ok := x.Files[file]
+	return entries, ok
+}
+
+// entryRecorder collects the regular files an extraction writes. A nil
+// *entryRecorder writes without recording.
+type entryRecorder struct {
+	dest    string
+	entries []indexEntry
+	// Position of each path in entries, as a later entry replaces an earlier one
+	seen map[string]int
+}
+
+func newEntryRecorder(dest string) *entryRecorder {
+	return &entryRecorder{dest: dest, seen: make(map[string]int)}
+}
+
+// copy writes the entry contents from r to out, recording target with the
+// checksum of what was written
+func (e *entryRecorder) copy(target string, out io.Writer, r io.Reader) error {
+	if e == nil {
+		_, err := io.Copy(out, r)
+		return err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hasher), r)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(e.dest, target)
+	if err != nil {
+		return err
+	}
+	entry := indexEntry{Path: filepath.ToSlash(rel), SHA256: hex.EncodeToString(hasher.Sum(nil)), Size: size}
+	if i, ok := e.seen[entry.Path]; ok {
+		e.entries[i] = entry
+		return nil
+	}
+	e.seen[entry.Path] = len(e.entries)
+	e.entries = append(e.entries, entry)
+	return nil
+}
+
+// recordFile indexes file as installing only itself, as plain files and
+// deltas do
+func (p *Patcher) recordFile(file string) {
+	sum, size, err := fileChecksum(p.directory + "/" + file)
+	if err != nil {
+		slog.Warn("Unable to index file", "file", file, "err", err)
+		p.index.forget(file)
+		return
+	}
+	p.index.set(file, []indexEntry{{Path: file, SHA256: sum, Size: size}})
+}
+
+// checkInstall marks the files whose installed files are all present and
+// unchanged as intact, so a repair only downloads the others. Files are
+// checked MaxDownloads at a time, each bar showing the bytes hashed.
+//
+// A path installed by several files holds what the last of them in the
+// manifest wrote, so only that one checks it. Applying an earlier file again
+// overwrites the path, so the later file is then applied again as well.
+func (p *Patcher) checkInstall() {
+	lists := make([][]indexEntry, len(p.downloads))
+	indexed := make([]bool, len(p.downloads))
+	owners := make(map[string]int)
+	for i, download := range p.downloads {
+		lists[i], indexed[i] = p.index.entries(download.file)
+		for _, entry := range lists[i] {
+			owners[entry.Path] = i
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, download := range p.downloads {
+		if !indexed[i] {
+			slog.Info("Not indexed, repairing", "file", download.file)
+			continue
+		}
+		var owned []indexEntry
+		for _, entry := range lists[i] {
+			if owners[entry.Path] == i {
+				owned = append(owned, entry)
+			}
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.slots.acquire()
+			defer p.slots.release()
+			p.downloads[i].intact = p.checkEntries(p.downloads[i], owned)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, download := range p.downloads {
+		if download.intact {
+			continue
+		}
+		for _, entry := range lists[i] {
+			if j := owners[entry.Path]; j > i && p.downloads[j].intact {
+				slog.Info("Applying again after an earlier file", "file", p.downloads[j].file, "after", download.file, "path", entry.Path)
+				p.downloads[j].intact = false
+				p.progress.FileStatus(j+1, "")
+			}
+		}
+	}
+}
+
+// checkEntries reports whether every file in entries matches its checksum
+func (p *Patcher) checkEntries(download *download, entries []indexEntry) bool {
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	p.progress.FileStatus(download.order, i18n.Tr("status.verifying"))
+	p.progress.FileProgress(download.order, 0, total)
+
+	var checked int64
+	for _, entry := range entries {
+		if p.ctx.Err() != nil {
+			return false
+		}
+		path := filepath.Join(p.directory, filepath.FromSlash(entry.Path))
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != entry.Size {
+			slog.Info("Installed file missing or changed, repairing", "file", download.file, "path", entry.Path, "err", err)
+			return false
+		}
+		if sum, _, err := fileChecksum(path); err != nil || sum != entry.SHA256 {
+			slog.Info("Installed file damaged, repairing", "file", download.file, "path", entry.Path, "err", err)
+			return false
+		}
+		checked += entry.Size
+		p.progress.FileProgress(download.order, checked, total)
+	}
+	slog.Info("Intact", "file", download.file, "files", len(entries))
+	p.progress.FileStatus(download.order, i18n.Tr("status.intact"))
+	return true
+}
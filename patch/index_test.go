@@ -0,0 +1,230 @@
+package patch
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveGets serves files as serveFiles does and counts the GET requests made
+// for each of them, which is what a repair should keep to the damaged files
+func serveGets(t *testing.T, files map[string][]byte) (*httptest.Server, func(name string) int) {
+	t.Helper()
+	var mu sync.Mutex
+	gets := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[1:]
+		data, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets[name]++
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server, func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return gets[name]
+	}
+}
+
+// repairFiles are two archives and a plain file, as a patch run installs them
+func repairFiles(t *testing.T) map[string][]byte {
+	return map[string][]byte{
+		"a.tar.gz": tarGz(t, tarEntry{name: "data/a1.txt", body: "a1"}, tarEntry{name: "data/a2.txt", body: "a2"}),
+		"b.tar.gz": tarGz(t, tarEntry{name: "data/b.txt", body: "b"}),
+		"c.MPQ":    []byte("MPQ\x1a c"),
+	}
+}
+
+// repair runs a repair of the install config patched and returns its outcome
+func repair(t *testing.T, config Config, manifest Manifest) *Result {
+	t.Helper()
+	config.Repair = true
+	progress := newTestProgress()
+	result := New(context.Background(), http.DefaultClient, config, manifest, progress).Run()
+	if result == nil {
+		t.Fatalf("repair did not start: %v", progress.errors)
+	}
+	return result
+}
+
+// repairedFiles returns the names of the files a repair applied again
+func repairedFiles(result *Result) []string {
+	var names []string
+	for _, file := range result.Repaired() {
+		names = append(names, file.File)
+	}
+	return names
+}
+
+func TestRunIndexesInstalledFiles(t *testing.T) {
+	files := repairFiles(t)
+	server := serveFiles(t, files)
+
+	for _, stream := range []bool{false, true} {
+		config := testConfig(t, server.URL)
+		config.Stream = stream
+		if result, _ := runPatcher(t, config, "a.tar.gz", "b.tar.gz", "c.MPQ"); !result.Success {
+			t.Fatalf("patch failed: %+v", result.Files)
+		}
+
+		index := loadIndex(config.Directory)
+		want := map[string][]string{
+			"a.tar.gz": {"data/a1.txt", "data/a2.txt"},
+			"b.tar.gz": {"data/b.txt"},
+			"c.MPQ":    {"c.MPQ"},
+		}
+		for file, paths := range want {
+			entries, ok := index.entries(file)
+			if !ok || len(entries) != len(paths) {
+				t.Errorf("stream %v: %s indexed as %+v, want %v", stream, file, entries, paths)
+				continue
+			}
+			for i, entry := range entries {
+				sum, size, err := fileChecksum(filepath.Join(config.Directory, entry.Path))
+				if entry.Path != paths[i] || err != nil || sum != entry.SHA256 || size != entry.Size {
+					t.Errorf("stream %v: %s entry %+v does not match the installed file (%v)", stream, file, entry, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRepairAppliesOnlyDamagedFiles(t *testing.T) {
+	files := repairFiles(t)
+	server, gets := serveGets(t, files)
+	config := testConfig(t, server.URL)
+	manifest := Manifest{Files: []string{"a.tar.gz", "b.tar.gz", "c.MPQ"}, Version: "v1"}
+	initial := New(context.Background(), http.DefaultClient, config, manifest, newTestProgress()).Run()
+	if initial == nil || !initial.Success {
+		t.Fatalf("patch failed: %+v", initial)
+	}
+
+	// A damaged entry of one archive and a missing plain file; the other
+	// archive is untouched
+	if err := os.WriteFile(filepath.Join(config.Directory, "data/a2.txt"), []byte("xx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(config.Directory, "c.MPQ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The version is current, which a repair does not trust
+	result := repair(t, config, manifest)
+	if !result.Success || !result.Repair {
+		t.Fatalf("repair failed: %+v", result)
+	}
+	if got := repairedFiles(result); len(got) != 2 || got[0] != "a.tar.gz" || got[1] != "c.MPQ" {
+		t.Errorf("repaired %v, want [a.tar.gz c.MPQ]", got)
+	}
+	if !result.Files[1].Intact {
+		t.Errorf("untouched b.tar.gz not intact: %+v", result.Files[1])
+	}
+	for file, want := range map[string]int{"a.tar.gz": 2, "b.tar.gz": 1, "c.MPQ": 2} {
+		if got := gets(file); got != want {
+			t.Errorf("%s fetched %d times, want %d", file, got, want)
+		}
+	}
+	if got := readFile(t, config.Directory, "data/a2.txt"); got != "a2" {
+		t.Errorf("data/a2.txt = %q after repair", got)
+	}
+	if got := readFile(t, config.Directory, "c.MPQ"); got != string(files["c.MPQ"]) {
+		t.Errorf("c.MPQ = %q after repair", got)
+	}
+}
+
+func TestRepairIntactInstallDownloadsNothing(t *testing.T) {
+	server, gets := serveGets(t, repairFiles(t))
+	config := testConfig(t, server.URL)
+	manifest := Manifest{Files: []string{"a.tar.gz", "b.tar.gz", "c.MPQ"}}
+	if result, _ := runPatcher(t, config, manifest.Files...); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+
+	result := repair(t, config, manifest)
+	if !result.Success {
+		t.Fatalf("repair failed: %+v", result.Files)
+	}
+	if got := repairedFiles(result); len(got) != 0 {
+		t.Errorf("repaired %v on an intact install", got)
+	}
+	for _, file := range manifest.Files {
+		if got := gets(file); got != 1 {
+			t.Errorf("%s fetched %d times, want only by the patch", file, got)
+		}
+	}
+}
+
+func TestRepairWithoutIndexAppliesEverything(t *testing.T) {
+	server, gets := serveGets(t, repairFiles(t))
+	config := testConfig(t, server.URL)
+	manifest := Manifest{Files: []string{"a.tar.gz", "c.MPQ"}}
+	if result, _ := runPatcher(t, config, manifest.Files...); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	// As left by a patcher that did not write an index
+	if err := os.Remove(filepath.Join(config.Directory, indexFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	result := repair(t, config, manifest)
+	if got := repairedFiles(result); len(got) != 2 {
+		t.Errorf("repaired %v, want every file", got)
+	}
+	if gets("a.tar.gz") != 2 || gets("c.MPQ") != 2 {
+		t.Errorf("fetched a.tar.gz %d and c.MPQ %d times, want 2 each", gets("a.tar.gz"), gets("c.MPQ"))
+	}
+}
+
+func TestRepairReappliesLaterFilesOverwritten(t *testing.T) {
+	// Both archives install shared.txt and b.tar.gz, applied last, wins
+	server, gets := serveGets(t, map[string][]byte{
+		"a.tar.gz": tarGz(t, tarEntry{name: "only-a.txt", body: "a"}, tarEntry{name: "shared.txt", body: "from a"}),
+		"b.tar.gz": tarGz(t, tarEntry{name: "shared.txt", body: "from b"}, tarEntry{name: "shared.txt", body: "from b, again"}),
+	})
+	config := testConfig(t, server.URL)
+	manifest := Manifest{Files: []string{"a.tar.gz", "b.tar.gz"}}
+	if result, _ := runPatcher(t, config, manifest.Files...); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if entries, _ := loadIndex(config.Directory).entries("b.tar.gz"); len(entries) != 1 {
+		t.Errorf("b.tar.gz indexed as %+v, want shared.txt once", entries)
+	}
+
+	t.Run("intact", func(t *testing.T) {
+		// shared.txt holds what b wrote, which a's checksum would not match
+		if got := repairedFiles(repair(t, config, manifest)); len(got) != 0 {
+			t.Errorf("repaired %v on an intact install", got)
+		}
+	})
+
+	t.Run("earlier file damaged", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(config.Directory, "only-a.txt")); err != nil {
+			t.Fatal(err)
+		}
+		// Applying a.tar.gz again overwrites shared.txt, so b.tar.gz follows
+		result := repair(t, config, manifest)
+		if got := repairedFiles(result); len(got) != 2 {
+			t.Errorf("repaired %v, want both archives", got)
+		}
+		if got := readFile(t, config.Directory, "shared.txt"); got != "from b, again" {
+			t.Errorf("shared.txt = %q after repair", got)
+		}
+		if gets("b.tar.gz") != 2 {
+			t.Errorf("b.tar.gz fetched %d times, want 2", gets("b.tar.gz"))
+		}
+	})
+}
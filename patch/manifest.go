@@ -0,0 +1,141 @@
+package patch
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Manifest listing the files that make up the current patch
+var manifestFile = "info.txt"
+
+// Manifest is the published description of the current patch
+type Manifest struct {
+	// Optional, lets an install that already has this version skip the patch
+	Version string
+	Files   []string
+	// Files that can be patched in place rather than downloaded again
+	Deltas []Delta
+	// Optional, the latest release of the patcher itself
+	LauncherVersion string
+	// Optional, the oldest patcher that can apply this patch
+	MinPatcherVersion string
+}
+
+// FetchManifest downloads the manifest from the first of sources that has it
+func FetchManifest(ctx context.Context, client *http.Client, sources []string) (Manifest, error) {
+	resp, err := Fetch(ctx, client, sources, manifestFile)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+
+	return parseManifest(resp.Body)
+}
+
+// parseManifest reads one file name per line, ignoring blank lines and #
+// comments. A "version <value>" line names the patch version, a
+// "launcher-version <value>" line the latest patcher and a
+// "min-patcher-version <value>" line the oldest one that may apply the patch;
+// file names cannot contain spaces, so none is mistaken for one. A
+// "delta <file> <base sha256> <target sha256> <patch>" line adds a file that
+// is updated with a bsdiff patch when the local copy matches the base. Names
+// are written straight into the install directory, so anything that is not a
+// plain file name is rejected.
+func parseManifest(r io.Reader) (Manifest, error) {
+	var manifest Manifest
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "version" {
+			if manifest.Version != "" {
+				return Manifest{}, fmt.Errorf("duplicate version in %s", manifestFile)
+			}
+			manifest.Version = fields[1]
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "launcher-version" {
+			if manifest.LauncherVersion != "" {
+				return Manifest{}, fmt.Errorf("duplicate launcher-version in %s", manifestFile)
+			}
+			manifest.LauncherVersion = fields[1]
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "min-patcher-version" {
+			if manifest.MinPatcherVersion != "" {
+				return Manifest{}, fmt.Errorf("duplicate min-patcher-version in %s", manifestFile)
+			}
+			manifest.MinPatcherVersion = fields[1]
+			continue
+		}
+
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "delta" {
+			delta, err := parseDelta(fields)
+			if err != nil {
+				return Manifest{}, err
+			}
+			if seen[delta.File] {
+				return Manifest{}, fmt.Errorf("duplicate file name in %s: %q", manifestFile, delta.File)
+			}
+			seen[delta.File] = true
+			manifest.Files = append(manifest.Files, delta.File)
+			manifest.Deltas = append(manifest.Deltas, delta)
+			continue
+		}
+
+		if !plainName(line) {
+			return Manifest{}, fmt.Errorf("malformed file name in %s: %q", manifestFile, line)
+		}
+		if seen[line] {
+			return Manifest{}, fmt.Errorf("duplicate file name in %s: %q", manifestFile, line)
+		}
+
+		seen[line] = true
+		manifest.Files = append(manifest.Files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return Manifest{}, err
+	}
+
+	if len(manifest.Files) == 0 {
+		return Manifest{}, errors.New(manifestFile + " does not list any files")
+	}
+
+	return manifest, nil
+}
+
+// parseDelta reads the fields of a delta line
+func parseDelta(fields []string) (Delta, error) {
+	if len(fields) != 5 {
+		return Delta{}, fmt.Errorf("malformed delta in %s: expected delta <file> <base sha256> <target sha256> <patch>", manifestFile)
+	}
+	delta := Delta{File: fields[1], Base: strings.ToLower(fields[2]), Target: strings.ToLower(fields[3]), Patch: fields[4]}
+	for _, name := range []string{delta.File, delta.Patch} {
+		if !plainName(name) {
+			return Delta{}, fmt.Errorf("malformed file name in %s: %q", manifestFile, name)
+		}
+	}
+	for _, sum := range []string{delta.Base, delta.Target} {
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+			return Delta{}, fmt.Errorf("malformed checksum for %s in %s: %q", delta.File, manifestFile, sum)
+		}
+	}
+	return delta, nil
+}
+
+// plainName reports whether name can be used as a file in the install
+// directory without leaving it
+func plainName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, "/\\ \t")
+}
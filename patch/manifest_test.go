@@ -0,0 +1,46 @@
+package patch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	manifest, err := parseManifest(strings.NewReader(`# Araxia client patch
+version v7
+launcher-version 1.4.0
+min-patcher-version 1.2.0
+
+patch-A.MPQ
+p.tar.gz
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != "v7" || manifest.LauncherVersion != "1.4.0" || manifest.MinPatcherVersion != "1.2.0" {
+		t.Errorf("versions = %q, %q, %q", manifest.Version, manifest.LauncherVersion, manifest.MinPatcherVersion)
+	}
+	if strings.Join(manifest.Files, " ") != "patch-A.MPQ p.tar.gz" {
+		t.Errorf("files = %v", manifest.Files)
+	}
+}
+
+func TestParseManifestRejects(t *testing.T) {
+	for name, text := range map[string]string{
+		"empty":               "# nothing\n",
+		"duplicate file":      "a.bin\na.bin\n",
+		"path":                "../a.bin\n",
+		"directory":           "Data/a.bin\n",
+		"duplicate version":   "version 1\nversion 2\na.bin\n",
+		"duplicate launcher":  "launcher-version 1\nlauncher-version 2\na.bin\n",
+		"duplicate min":       "min-patcher-version 1\nmin-patcher-version 2\na.bin\n",
+		"short delta":         "delta a.bin\n",
+		"bad delta checksum":  "delta a.bin xyz " + strings.Repeat("0", 64) + " a.patch\n",
+		"delta path":          "delta a.bin " + strings.Repeat("0", 64) + " " + strings.Repeat("1", 64) + " ../a.patch\n",
+		"file named as delta": "a.bin\ndelta a.bin " + strings.Repeat("0", 64) + " " + strings.Repeat("1", 64) + " a.patch\n",
+	} {
+		if _, err := parseManifest(strings.NewReader(text)); err == nil {
+			t.Errorf("%s: manifest %q accepted", name, text)
+		}
+	}
+}
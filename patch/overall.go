@@ -0,0 +1,62 @@
+package patch
+
+import "sync"
+
+// overallProgress combines the progress of every download into a single total.
+// Downloads report from their own goroutines, so the sums are kept under a lock.
+type overallProgress struct {
+	mu      sync.Mutex
+	current []int64
+	total   []int64
+	// Cancelled files no longer count towards either sum
+	skipped []bool
+}
+
+// newOverallProgress tracks count files, none of them sized yet
+func newOverallProgress(count int) *overallProgress {
+	return &overallProgress{
+		current: make([]int64, count),
+		total:   make([]int64, count),
+		skipped: make([]bool, count),
+	}
+}
+
+// update records the latest byte counts for one file and returns the sums
+// across all files. The total is -1 until every file has reported its size.
+func (o *overallProgress) update(order int, current int64, total int64) (int64, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.current[order-1] = current
+	o.total[order-1] = total
+	return o.sums()
+}
+
+// skip leaves a cancelled file out of the sums and returns them as update does
+func (o *overallProgress) skip(order int) (int64, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.skipped[order-1] = true
+	return o.sums()
+}
+
+func (o *overallProgress) sums() (int64, int64) {
+	var sumCurrent, sumTotal int64
+	known := true
+	for i := range o.total {
+		if o.skipped[i] {
+			continue
+		}
+		sumCurrent += o.current[i]
+		sumTotal += o.total[i]
+		if o.total[i] <= 0 {
+			known = false
+		}
+	}
+
+	if !known {
+		return sumCurrent, -1
+	}
+	return sumCurrent, sumTotal
+}
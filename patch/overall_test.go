@@ -0,0 +1,69 @@
+package patch
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestOverallProgressConcurrentUpdates(t *testing.T) {
+	const files, steps = 8, 1000
+	o := newOverallProgress(files)
+
+	// Every file reports from its own goroutine, as downloads do; run with
+	// -race to check the sums are kept safely
+	var wg sync.WaitGroup
+	for order := 1; order <= files; order++ {
+		wg.Add(1)
+		go func(order int) {
+			defer wg.Done()
+			for step := int64(1); step <= steps; step++ {
+				current, total := o.update(order, step, steps)
+				if total != -1 && current > total {
+					t.Errorf("sums %d of %d", current, total)
+				}
+			}
+		}(order)
+	}
+	wg.Wait()
+
+	if current, total := o.update(1, steps, steps); current != files*steps || total != files*steps {
+		t.Errorf("final sums %d of %d, want %d of %d", current, total, files*steps, files*steps)
+	}
+}
+
+func TestOverallProgressSkip(t *testing.T) {
+	o := newOverallProgress(3)
+	o.update(1, 10, 100)
+	o.update(2, 20, 200)
+	if current, total := o.sums(); current != 30 || total != -1 {
+		t.Errorf("sums with an unknown size = %d of %d, want 30 of -1", current, total)
+	}
+	// The cancelled file no longer counts, so the total becomes known
+	if current, total := o.skip(3); current != 30 || total != 300 {
+		t.Errorf("sums after skipping = %d of %d, want 30 of 300", current, total)
+	}
+}
+
+func TestRunOverallCountsEveryByteOnce(t *testing.T) {
+	files := make(map[string][]byte)
+	var names []string
+	var size int64
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("f%d.bin", i)
+		files[name] = bytes.Repeat([]byte{byte(i)}, 50000+i*1000)
+		names = append(names, name)
+		size += int64(len(files[name]))
+	}
+	config := testConfig(t, serveFiles(t, files).URL)
+	config.MaxDownloads = 8
+
+	result, progress := runPatcher(t, config, names...)
+	if !result.Success || result.TotalBytes != size {
+		t.Fatalf("patch got %d bytes, want %d: %+v", result.TotalBytes, size, result.Files)
+	}
+	if last := progress.overall[len(progress.overall)-1]; last != [2]int64{size, size} {
+		t.Errorf("overall progress ends at %v, want %d of %d", last, size, size)
+	}
+}
@@ -0,0 +1,104 @@
+// Package patch downloads the files listed in a patch manifest, resuming,
+// verifying and retrying them as needed, and extracts them into an install
+// directory. A Patcher reports what it does to a Progress, so any front-end
+// can render the run.
+package patch
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Source the Araxia client patch is published to
+const DefaultSource = "https://storage.googleapis.com/araxia-client-patches/Updatev1/"
+
+// Files downloaded at the same time when the config does not say
+const DefaultMaxDownloads = 4
+
+// Config holds the settings of a patch run. The zero value patches the
+// current directory from DefaultSource.
+type Config struct {
+	// Install directory the patch is applied to
+	Directory string
+	// Base URL of the patch files, DefaultSource if empty, and the mirrors
+	// tried in order when a file cannot be fetched from it
+	Source  string
+	Mirrors []string
+	// Number of files downloaded at the same time, DefaultMaxDownloads if 0
+	MaxDownloads int
+	// Cap on the combined download rate in bytes per second, 0 for no limit
+	MaxRate int64
+	// Archives are deleted once extracted unless this is set
+	KeepArchives bool
+	// Files replaced by the patch are moved aside first when this is set, and
+	// put back if the patch fails
+	Backup bool
+	// Gzipped tar archives are extracted while they download instead of being
+	// written to disk first, see Patcher.streamable
+	Stream bool
+	// Every file is checked against the install index instead of trusting the
+	// version marker, and only the missing or damaged ones are applied again
+	Repair bool
+}
+
+// withDefaults fills in the settings left empty
+func (c Config) withDefaults() Config {
+	if c.Directory == "" {
+		c.Directory = "."
+	}
+	if c.Source == "" {
+		c.Source = DefaultSource
+	}
+	if !strings.HasSuffix(c.Source, "/") {
+		c.Source += "/"
+	}
+	if c.MaxDownloads < 1 {
+		c.MaxDownloads = DefaultMaxDownloads
+	}
+	return c
+}
+
+// Sources returns the patch source followed by its mirrors, in the order they are tried
+func (c Config) Sources() []string {
+	c = c.withDefaults()
+	return append([]string{c.Source}, c.Mirrors...)
+}
+
+// A download is abandoned (and retried) when no bytes arrive for this long
+var stallTimeout = 30 * time.Second
+
+var errStalled = errors.New("download stalled")
+
+// Weight of the newest sample in the smoothed download speed
+var speedSmoothing = 0.3
+
+// Size of each read from the response body, and how often progress is
+// reported while a download runs
+var bufferSize = 256 * 1024
+var uiUpdateInterval = 100 * time.Millisecond
+
+// Retries after a failed download, waiting retryDelay before the first and
+// doubling the wait each time after that
+var downloadRetries = 3
+var retryDelay = time.Second
+
+// A failed attempt during which the wall clock ran this far ahead of the
+// monotonic clock, which stops while the machine is suspended, is taken as a
+// sleep rather than a failure
+var suspendGap = 10 * time.Second
+
+// sleptSince returns how long the machine was suspended since start
+var sleptSince = func(start time.Time) time.Duration {
+	now := time.Now()
+	return now.Round(0).Sub(start.Round(0)) - now.Sub(start)
+}
+
+// smoothSpeed folds a new speed sample into an exponential moving average so
+// the time estimate does not jump around with every sample
+func smoothSpeed(average float64, sample float64) float64 {
+	if average == 0 {
+		return sample
+	}
+	return speedSmoothing*sample + (1-speedSmoothing)*average
+}
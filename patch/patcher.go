@@ -0,0 +1,836 @@
+package patch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// Progress renders a patch run. Files are identified by their position in the
+// manifest, starting at 1. Methods are called from the download goroutines, so
+// implementations must be safe for concurrent use.
+type Progress interface {
+	// FileStatus shows a short status such as "waiting…", clearing any failure
+	FileStatus(order int, status string)
+	// FileProgress reports bytes done out of total, which is -1 when unknown
+	FileProgress(order int, current int64, total int64)
+	// FileSpeed reports the smoothed rate and the bytes left, -1 when unknown
+	FileSpeed(order int, speed float64, remaining int64)
+	// FileFailed marks a file as failed with a short reason and the full error
+	FileFailed(order int, reason string, err error)
+	// OverallSpeed reports the combined rate of every running download
+	OverallSpeed(speed float64)
+	// DownloadFinished is called once a file will not be downloaded any further
+	DownloadFinished(order int)
+	// Overall reports bytes done across all files; total is -1 until every size is known
+	Overall(current int64, total int64)
+	// Error reports a problem that stops the patch before anything is written
+	Error(message string)
+	// Finished is called with the outcome once the run is over
+	Finished(result *Result)
+}
+
+// download is the state of one file in a patch run
+type download struct {
+	order int
+	file  string
+	// Written by the download goroutine and read by everything else
+	total   atomic.Int64
+	current atomic.Int64
+	// Bits of the smoothed speed as a float64, 0 while not downloading
+	speed atomic.Uint64
+
+	// Done once the run stops or the player cancels this file, see Cancel
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// A delta file whose local copy can be patched, set before downloads start
+	usePatch bool
+	// Extracted while downloading, so there is no archive left to extract.
+	// Only read once every download has finished.
+	streamed bool
+	// Found intact by a repair, so it is not downloaded or applied again. Set
+	// before downloads start.
+	intact bool
+
+	// Pause state, shared between the UI and the download goroutine
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	stop    context.CancelCauseFunc
+}
+
+// Patcher downloads, verifies and extracts the files of a patch into an
+// install directory, reporting what it does to a Progress
+type Patcher struct {
+	ctx    context.Context
+	client *http.Client
+	// Guards the sources in config, which SetSources may change while
+	// downloads are running
+	mu        sync.RWMutex
+	config    Config
+	directory string
+	files     []string
+	version   string
+	checksums map[string]string
+	deltas    map[string]Delta
+	downloads []*download
+	overall   *overallProgress
+	progress  Progress
+	limiter   *rateLimiter
+	slots     *downloadSlots
+	// With config.Backup, where replaced files are kept; nil otherwise
+	bak *backup
+	// What each manifest file installed, saved when Run ends
+	index *installIndex
+}
+
+// New prepares a run over the files of manifest. Every request goes through
+// client, so callers decide on transports, proxies and timeouts. Settings
+// left empty in config take their defaults. progress may be nil when the
+// patcher is only used for Plan.
+func New(ctx context.Context, client *http.Client, config Config, manifest Manifest, progress Progress) *Patcher {
+	config = config.withDefaults()
+	p := &Patcher{
+		ctx:       ctx,
+		client:    client,
+		config:    config,
+		directory: config.Directory,
+		files:     manifest.Files,
+		version:   manifest.Version,
+		overall:   newOverallProgress(len(manifest.Files)),
+		progress:  progress,
+		limiter:   newRateLimiter(config.MaxRate),
+		slots:     newDownloadSlots(config.MaxDownloads),
+		deltas:    make(map[string]Delta),
+		index:     loadIndex(config.Directory),
+	}
+	for _, delta := range manifest.Deltas {
+		p.deltas[delta.File] = delta
+	}
+	for i, file := range p.files {
+		download := &download{order: i + 1, file: file}
+		download.ctx, download.cancel = context.WithCancelCause(ctx)
+		p.downloads = append(p.downloads, download)
+	}
+	return p
+}
+
+// Run patches the install directory and returns the outcome, which is also
+// written to the result file. It returns nil if the patch could not be started.
+func (p *Patcher) Run() *Result {
+	// A repair checks the files themselves rather than trusting the version
+	if !p.config.Repair && p.upToDateVersion() {
+		return p.skip()
+	}
+
+	checksums, err := FetchChecksums(p.ctx, p.client, p.sources())
+	if err != nil {
+		slog.Warn("Unable to fetch checksums, downloads will not be verified", "err", err)
+	}
+	p.checksums = checksums
+	p.checkDeltas()
+	if p.config.Repair {
+		p.checkInstall()
+	}
+
+	sizes := p.fetchSizes()
+	if err := checkDiskSpace(p.directory, sizes); err != nil {
+		slog.Error("Unable to patch", "directory", p.directory, "err", err)
+		p.progress.Error(i18n.Tr("dialog.unable", err.Error()))
+		return nil
+	}
+
+	result := newResult(p.version, len(p.files))
+	result.Repair = p.config.Repair
+
+	// With config.Backup every file the archives and deltas replace can be put back
+	// if the patch fails
+	if p.config.Backup {
+		p.bak = newBackup(p.directory)
+	}
+
+	p.downloadAll(result)
+
+	// Extract the patch archives
+	for i, file := range p.files {
+		if !result.Files[i].Success || result.Files[i].Intact {
+			continue
+		}
+		// Nothing more is extracted once the user has asked to stop
+		if err := p.ctx.Err(); err != nil {
+			result.Files[i].fail(err)
+			continue
+		}
+		// Deltas and streamed archives are applied as soon as they are downloaded
+		if _, ok := p.deltas[file]; ok {
+			p.recordFile(file)
+			p.progress.FileStatus(i+1, p.doneStatus(file))
+			continue
+		}
+		if p.downloads[i].streamed {
+			p.progress.FileStatus(i+1, p.doneStatus(file))
+			continue
+		}
+		slog.Info("Extracting", "file", file)
+		size := p.downloads[i].total.Load()
+		p.progress.FileStatus(i+1, i18n.Tr("status.extracting"))
+		p.progress.FileProgress(i+1, 0, size)
+		rec := newEntryRecorder(p.directory)
+		archive, err := extract(p.directory+"/"+file, p.directory, p.bak, rec, p.extractProgress(i+1))
+		if err != nil {
+			slog.Error("Extraction failed", "file", file, "err", err)
+			p.index.forget(file)
+			result.Files[i].fail(err)
+			p.progress.FileFailed(i+1, i18n.Tr("failed.extraction"), err)
+			continue
+		}
+		p.progress.FileProgress(i+1, size, size)
+		p.progress.FileStatus(i+1, p.doneStatus(file))
+		// Files that are not archives are the payload itself and stay
+		if !archive {
+			slog.Info("Not an archive, keeping as downloaded", "file", file)
+			p.recordFile(file)
+			continue
+		}
+		slog.Info("Extracted", "file", file)
+		p.index.set(file, rec.entries)
+		if !p.config.KeepArchives {
+			removeArchive(p.directory + "/" + file)
+		}
+	}
+
+	result.finish()
+	// Restoring a backup puts back files the index no longer describes
+	if result.Success || p.bak == nil {
+		if err := p.index.save(p.directory); err != nil {
+			slog.Error("Unable to write install index", "err", err)
+		}
+	}
+	if !result.Success {
+		restoreBackup(p.bak)
+	} else if p.version != "" && !result.skipped() {
+		// A later run offers the cancelled files again
+		if err := writeVersion(p.directory, p.version); err != nil {
+			slog.Error("Unable to write patch version", "err", err)
+		}
+	}
+	if err := result.write(p.directory); err != nil {
+		slog.Error("Unable to write patch result", "err", err)
+	}
+	slog.Info("Patch finished", "success", result.Success, "bytes", result.TotalBytes, "duration", time.Since(result.StartedAt))
+	p.progress.Finished(result)
+	return result
+}
+
+// verifiable reports whether file has a checksum its download is checked against
+func (p *Patcher) verifiable(file string) bool {
+	_, ok := p.checksums[file]
+	return ok
+}
+
+// doneStatus is the status of an applied file, which tells the player when
+// nothing could check it
+func (p *Patcher) doneStatus(file string) string {
+	if !p.verifiable(file) {
+		return i18n.Tr("status.unverified")
+	}
+	return i18n.Tr("status.done")
+}
+
+// upToDateVersion reports whether the install already has the manifest's version
+func (p *Patcher) upToDateVersion() bool {
+	return p.version != "" && localVersion(p.directory) == p.version
+}
+
+// skip finishes a run without downloading anything because the install is
+// already at the manifest's version
+func (p *Patcher) skip() *Result {
+	slog.Info("Already up to date", "version", p.version)
+
+	result := newResult(p.version, len(p.files))
+	result.UpToDate = true
+	for i, file := range p.files {
+		result.Files[i] = newFileResult(file, 0, 0, nil)
+		p.progress.FileStatus(i+1, i18n.Tr("status.upToDate"))
+		p.progress.DownloadFinished(i + 1)
+	}
+	result.finish()
+	if err := result.write(p.directory); err != nil {
+		slog.Error("Unable to write patch result", "err", err)
+	}
+	p.progress.Finished(result)
+	return result
+}
+
+// downloadAll downloads every file in parallel and records each outcome in
+// result. It returns only once every download has finished or given up.
+func (p *Patcher) downloadAll(result *Result) {
+	var wg sync.WaitGroup
+
+	for i, file := range p.files {
+		if p.downloads[i].intact {
+			result.Files[i] = FileResult{File: file, Success: true, Intact: true}
+			p.progress.DownloadFinished(i + 1)
+			continue
+		}
+		p.progress.FileStatus(i+1, i18n.Tr("status.waiting"))
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			// Only config.MaxDownloads run at once, the rest queue for a free slot
+			p.slots.acquire()
+			defer p.slots.release()
+
+			p.progress.FileStatus(i+1, "")
+			start := time.Now()
+			var err error
+			if _, ok := p.deltas[file]; ok {
+				err = p.downloadDelta(i + 1)
+			} else {
+				err = p.downloadWithRetry(file, i+1)
+			}
+			if errors.Is(err, errCancelled) {
+				slog.Info("Download cancelled", "file", file)
+				p.progress.FileStatus(i+1, i18n.Tr("status.cancelled"))
+				p.progress.Overall(p.overall.skip(i + 1))
+			}
+			p.progress.DownloadFinished(i + 1)
+			result.Files[i] = newFileResult(file, p.downloads[i].current.Load(), time.Since(start), err)
+			result.Files[i].Unverified = result.Files[i].Success && !p.verifiable(file)
+		}(i, file)
+	}
+
+	wg.Wait()
+}
+
+// Cancel stops one download for good, leaving the others running. Its partial
+// file is removed and it is skipped rather than counted as a failure, unless
+// it was being streamed and had already extracted entries: those cannot be
+// taken back, so the file fails and a backup is restored.
+func (p *Patcher) Cancel(order int) {
+	p.downloads[order-1].cancel(errCancelled)
+}
+
+// SetSources replaces the patch source and mirrors for every later request
+func (p *Patcher) SetSources(source string, mirrors []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config.Source = source
+	p.config.Mirrors = mirrors
+}
+
+// sources returns the patch source followed by its mirrors, in the order they are tried
+func (p *Patcher) sources() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.Sources()
+}
+
+// SetMaxDownloads changes how many files download at once, DefaultMaxDownloads
+// if limit is 0. Downloads already running above a lowered limit finish first.
+func (p *Patcher) SetMaxDownloads(limit int) {
+	if limit < 1 {
+		limit = DefaultMaxDownloads
+	}
+	p.slots.setLimit(limit)
+}
+
+// SetMaxRate changes the combined rate cap, 0 for none, for every download
+// that has not finished yet
+func (p *Patcher) SetMaxRate(bytesPerSecond int64) {
+	p.limiter.setRate(bytesPerSecond)
+}
+
+// TogglePause pauses or resumes one download and returns whether it is now
+// paused. A paused download leaves its place to the next one in the queue.
+func (p *Patcher) TogglePause(order int) bool {
+	return p.downloads[order-1].togglePause()
+}
+
+// Size requests sent at the same time by fetchSizes
+var sizeRequests = 8
+
+// fetchSizes asks for every file's size before downloading, so the bars have
+// their scale from the first byte. Up to sizeRequests files are asked about at
+// once, each from the source and then the mirrors. Sizes no source reports are
+// returned as -1 and those bars learn their total from the download.
+func (p *Patcher) fetchSizes() []int64 {
+	sizes := make([]int64, len(p.files))
+	sources := p.sources()
+	slots := make(chan struct{}, sizeRequests)
+	var wg sync.WaitGroup
+	for i, download := range p.downloads {
+		// Intact files are not downloaded, so they take no space or progress
+		if download.intact {
+			p.progress.Overall(p.overall.skip(download.order))
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			download := p.downloads[i]
+			file := p.remoteName(download)
+			size, err := headSizeFrom(p.ctx, p.client, sources, file)
+			if err != nil {
+				slog.Warn("Unable to get file size", "file", file, "err", err)
+				size = -1
+			}
+			sizes[i] = size
+
+			if size > 0 {
+				download.total.Store(size)
+				p.refresh(download)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return sizes
+}
+
+// refresh reports a file's counters and the overall progress
+func (p *Patcher) refresh(download *download) {
+	current, total := download.current.Load(), download.total.Load()
+	if total <= 0 {
+		total = -1
+	}
+	p.progress.FileProgress(download.order, current, total)
+	p.progress.Overall(p.overall.update(download.order, current, total))
+}
+
+// downloadWithRetry downloads a file, backing off and retrying on failure. Each
+// attempt resumes from whatever the previous ones, or an earlier run, managed
+// to write to the .part file, which only takes the file's name once it is
+// complete and verified. If the download is given up on, the .part is kept for
+// the next run to resume, unless the player cancelled the download. It runs
+// holding a download slot, which it gives up while paused.
+func (p *Patcher) downloadWithRetry(file string, order int) (err error) {
+	path := p.directory + "/" + file
+	defer func() {
+		if errors.Is(err, errCancelled) {
+			removePartial(path + partSuffix)
+		}
+	}()
+
+	download := p.downloads[order-1]
+	if p.upToDate(path, download) {
+		return nil
+	}
+
+	delay := retryDelay
+
+	for retry := 0; ; {
+		started := time.Now()
+		err = p.downloadFromSources(file, order)
+
+		// A pause stops the attempt without counting as a failure. The slot is
+		// given up while paused so the queued downloads can use it, and the
+		// download queues for one again on resume.
+		if errors.Is(err, errPaused) {
+			p.slots.release()
+			if err = download.waitForResume(download.ctx); err != nil {
+				// Stopping, not downloading, so there is nothing to queue for
+				p.slots.reclaim()
+				return err
+			}
+			p.slots.acquire()
+			continue
+		}
+
+		if err == nil {
+			return completePart(path, download)
+		}
+		if download.ctx.Err() != nil {
+			return err
+		}
+
+		// Connections drop while the machine sleeps. That says nothing about
+		// the server, so the download picks up again without using a retry.
+		if slept := sleptSince(started); slept >= suspendGap {
+			slog.Info("Resuming download after suspend", "file", file, "slept", slept.Round(time.Second), "err", err)
+			delay = retryDelay
+			continue
+		}
+		if retry == downloadRetries {
+			return err
+		}
+
+		// Missing or forbidden files will not appear by asking again, and
+		// entries that could not be written will fail the same way
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && !statusErr.temporary() {
+			return err
+		}
+		var extractErr *extractError
+		if errors.As(err, &extractErr) {
+			return err
+		}
+
+		retry++
+		slog.Warn("Retrying download", "file", file, "delay", delay, "retry", retry, "of", downloadRetries, "err", err)
+		p.progress.FileStatus(order, i18n.Tr("status.retry", retry, downloadRetries))
+		select {
+		case <-time.After(delay):
+		case <-download.ctx.Done():
+			return context.Cause(download.ctx)
+		}
+		delay *= 2
+	}
+}
+
+// upToDate reports whether a local copy of the file already matches its
+// expected checksum, in which case it is shown complete and not downloaded
+func (p *Patcher) upToDate(path string, download *download) bool {
+	expected, ok := p.checksums[download.file]
+	if !ok {
+		return false
+	}
+
+	sum, size, err := fileChecksum(path)
+	if err != nil || sum != expected {
+		return false
+	}
+
+	slog.Info("Already up to date", "file", download.file, "bytes", size)
+	download.total.Store(size)
+	download.current.Store(size)
+	p.refresh(download)
+	p.progress.FileStatus(download.order, i18n.Tr("status.upToDate"))
+	return true
+}
+
+// downloadFromSources tries the patch source and then each mirror in turn,
+// moving on as soon as one fails. Each attempt resumes from the bytes already written.
+func (p *Patcher) downloadFromSources(file string, order int) error {
+	download := p.downloads[order-1]
+	var err error
+	list := p.sources()
+	for i, source := range list {
+		if i > 0 {
+			slog.Info("Trying mirror", "file", file, "source", source)
+			p.progress.FileStatus(order, i18n.Tr("status.mirror", i, len(list)-1))
+		}
+
+		err = p.downloadFile(source, file, order)
+		if err == nil || errors.Is(err, errPaused) || download.ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// removeArchive deletes an archive once it has been extracted. Failing to do
+// so only wastes space, so the patch still counts as applied.
+func removeArchive(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Unable to remove archive", "path", path, "err", err)
+		return
+	}
+	slog.Info("Removed archive", "path", path)
+}
+
+// Suffix of a file while it downloads, see downloadWithRetry
+var partSuffix = ".part"
+
+// completePart gives a finished download its final name, replacing any older
+// copy. Streamed archives were never written to disk and have nothing to rename.
+func completePart(path string, download *download) error {
+	if download.streamed {
+		return nil
+	}
+	if err := os.Rename(path+partSuffix, path); err != nil {
+		slog.Error("Unable to rename download", "path", path+partSuffix, "err", err)
+		return err
+	}
+	os.Remove(path + partSuffix + segmentsSuffix)
+	return nil
+}
+
+// removePartial deletes an incomplete download and any segment state saved
+// for it
+func removePartial(path string) {
+	os.Remove(path + segmentsSuffix)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Unable to remove partial file", "path", path, "err", err)
+		return
+	}
+	slog.Info("Removed partial file", "path", path)
+}
+
+// downloadFile makes one attempt at downloading file from source into its
+// .part file, checking it against its checksum once complete
+func (p *Patcher) downloadFile(source string, file string, order int) error {
+	path := p.directory + "/" + file + partSuffix
+
+	// Pick up where a previous run left off if a partial file exists
+	offset := int64(0)
+	if info, err := os.Stat(path); err == nil {
+		offset = info.Size()
+	}
+
+	download := p.downloads[order-1]
+
+	// Abort the attempt if the server stops sending, whether before the
+	// response arrives or part way through the body
+	ctx, cancel := context.WithCancelCause(download.ctx)
+	defer cancel(nil)
+	if !download.begin(cancel) {
+		return errPaused
+	}
+	defer download.end()
+	stall := time.AfterFunc(stallTimeout, func() { cancel(errStalled) })
+	defer stall.Stop()
+
+	// A segmented .part is preallocated to the full size, so it picks up each
+	// of its ranges where it stopped rather than resuming at its end
+	if state := loadSegmentState(path); state != nil && offset > 0 {
+		defer p.setSpeed(download, 0)
+		if err := p.downloadSegmented(ctx, stall, nil, source, file, order, state); err != nil {
+			return err
+		}
+		return p.verify(path, file, order)
+	}
+
+	resp, err := requestFile(ctx, p.client, source, file, offset)
+	if err != nil {
+		err = downloadError(ctx, err)
+		if stopped(err) {
+			return err
+		}
+		slog.Error("Download failed", "file", file, "source", source, "err", err)
+		p.progress.FileFailed(order, i18n.Tr("failed.download"), err)
+		return err
+	}
+	defer resp.Body.Close()
+	defer p.setSpeed(download, 0)
+
+	total := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		total = contentRangeTotal(resp, offset)
+	} else {
+		offset = 0
+	}
+	// A body of unknown length is held to the size HEAD reported
+	if total < 0 {
+		total = download.total.Load()
+	}
+
+	if offset == 0 && p.streamable(file) {
+		return p.downloadStreamed(ctx, stall, resp.Body, source, file, order, total)
+	}
+
+	// Large files come down faster as several ranges at once. They cannot be
+	// hashed in order, so the finished file is read back to verify it.
+	if offset == 0 && segmentable(resp, total) {
+		if err := p.downloadSegmented(ctx, stall, resp, source, file, order, newSegmentState(total)); err != nil {
+			return err
+		}
+		return p.verify(path, file, order)
+	}
+
+	// Hash the bytes as they are written so the file never has to be re-read
+	hasher := sha256.New()
+	out, err := openOutput(path, offset, hasher)
+	if err != nil {
+		slog.Error("Unable to create file", "path", path, "err", err)
+		return err
+	}
+	defer out.Close()
+	writer := io.MultiWriter(out, hasher)
+
+	download.total.Store(total)
+	download.current.Store(offset)
+	p.refresh(download)
+
+	start := time.Now()
+	lastTime := start
+	lastUpdate := start
+	lastBytes := offset
+	smoothed := 0.0
+
+	// Every download draws from the same limiter, which lets reads through
+	// unchanged while there is no rate cap
+	body := p.limiter.reader(ctx, resp.Body)
+
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			stall.Reset(stallTimeout)
+			if _, err := writer.Write(buf[:n]); err != nil {
+				slog.Error("Unable to write file", "path", path, "err", err)
+				return err
+			}
+			current := download.current.Add(int64(n))
+			now := time.Now()
+			elapsed := now.Sub(lastTime).Seconds()
+			if elapsed >= 1 { // Update speed label every second
+				speed := float64(current-lastBytes) / elapsed
+				smoothed = smoothSpeed(smoothed, speed)
+				remaining := int64(-1)
+				if total > 0 {
+					remaining = total - current
+				}
+				p.progress.FileSpeed(order, smoothed, remaining)
+				p.setSpeed(download, smoothed)
+				lastBytes = current
+				lastTime = now
+			}
+			if now.Sub(lastUpdate) >= uiUpdateInterval {
+				p.refresh(download)
+				lastUpdate = now
+			}
+		}
+		if err == io.EOF {
+			p.refresh(download)
+			break
+		}
+		if err != nil {
+			err = downloadError(ctx, err)
+			if !stopped(err) {
+				slog.Error("Download interrupted", "file", file, "source", source, "bytes", download.current.Load(), "err", err)
+			}
+			// The body ended before its Content-Length
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				p.progress.FileFailed(order, i18n.Tr("failed.incomplete"), err)
+			}
+			return err
+		}
+	}
+
+	// A connection dropped early can still end in a clean EOF. The bytes that
+	// did arrive are kept so the retry resumes after them.
+	if current := download.current.Load(); total > 0 && current != total {
+		err := fmt.Errorf("incomplete download of %s: got %d of %d bytes", file, current, total)
+		slog.Error("Incomplete download", "file", file, "source", source, "bytes", current, "expected", total)
+		p.progress.FileFailed(order, i18n.Tr("failed.incomplete"), err)
+		return err
+	}
+
+	if expected, ok := p.checksums[file]; ok {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if sum != expected {
+			slog.Error("Checksum mismatch", "file", file, "expected", expected, "got", sum)
+			err := fmt.Errorf("checksum mismatch for %s: expected %s, got %s", file, expected, sum)
+			p.progress.FileFailed(order, i18n.Tr("failed.checksum"), err)
+			// Resuming would only append to the bad bytes
+			removePartial(path)
+			return err
+		}
+	}
+
+	slog.Info("Downloaded", "file", file, "source", source, "bytes", download.current.Load(), "duration", time.Since(start))
+	return nil
+}
+
+// setSpeed records a download's current rate and reports the sum across all
+// downloads. Each download only writes its own slot, the sum reads them all.
+func (p *Patcher) setSpeed(download *download, speed float64) {
+	download.speed.Store(math.Float64bits(speed))
+
+	total := 0.0
+	for _, d := range p.downloads {
+		total += math.Float64frombits(d.speed.Load())
+	}
+	p.progress.OverallSpeed(total)
+}
+
+// verify checks a finished download against its expected checksum, if any,
+// by reading it back from disk
+func (p *Patcher) verify(path string, file string, order int) error {
+	expected, ok := p.checksums[file]
+	if !ok {
+		return nil
+	}
+
+	sum, _, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		slog.Error("Checksum mismatch", "file", file, "expected", expected, "got", sum)
+		err := fmt.Errorf("checksum mismatch for %s: expected %s, got %s", file, expected, sum)
+		p.progress.FileFailed(order, i18n.Tr("failed.checksum"), err)
+		removePartial(path)
+		return err
+	}
+	return nil
+}
+
+// extractProgress returns an extract progress callback that reports to the
+// file's progress at most once per uiUpdateInterval
+func (p *Patcher) extractProgress(order int) func(read int64, total int64) {
+	var lastUpdate time.Time
+	return func(read int64, total int64) {
+		now := time.Now()
+		if now.Sub(lastUpdate) < uiUpdateInterval && read < total {
+			return
+		}
+		lastUpdate = now
+		p.progress.FileProgress(order, read, total)
+	}
+}
+
+// downloadSlots limits how many downloads run at once. Unlike a buffered
+// channel the limit can change while downloads are queued.
+type downloadSlots struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	used  int
+	limit int
+}
+
+func newDownloadSlots(limit int) *downloadSlots {
+	s := &downloadSlots{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire waits until a slot is free and takes it
+func (s *downloadSlots) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.used >= s.limit {
+		s.cond.Wait()
+	}
+	s.used++
+}
+
+// reclaim takes a slot back without waiting, for a download that only ends
+// and releases it again
+func (s *downloadSlots) reclaim() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used++
+}
+
+func (s *downloadSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.cond.Broadcast()
+}
+
+// setLimit changes the number of slots. Downloads already running above a
+// lowered limit finish, and no new one starts until enough of them have.
+func (s *downloadSlots) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.cond.Broadcast()
+}
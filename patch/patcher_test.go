@@ -0,0 +1,879 @@
+package patch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// testProgress records what a Patcher reports so tests can inspect it
+type testProgress struct {
+	mu       sync.Mutex
+	statuses map[int][]string
+	failed   map[int]error
+	reasons  map[int]string
+	done     map[int]bool
+	current  map[int][]int64
+	overall  [][2]int64
+	speeds   []float64
+	errors   []string
+	result   *Result
+}
+
+func newTestProgress() *testProgress {
+	return &testProgress{
+		statuses: make(map[int][]string),
+		failed:   make(map[int]error),
+		reasons:  make(map[int]string),
+		done:     make(map[int]bool),
+		current:  make(map[int][]int64),
+	}
+}
+
+func (t *testProgress) FileStatus(order int, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statuses[order] = append(t.statuses[order], status)
+}
+
+func (t *testProgress) FileProgress(order int, current int64, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current[order] = append(t.current[order], current)
+}
+
+func (t *testProgress) FileSpeed(order int, speed float64, remaining int64) {}
+
+func (t *testProgress) FileFailed(order int, reason string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed[order] = err
+	t.reasons[order] = reason
+}
+
+func (t *testProgress) OverallSpeed(speed float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.speeds = append(t.speeds, speed)
+}
+
+func (t *testProgress) DownloadFinished(order int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[order] = true
+}
+
+func (t *testProgress) Overall(current int64, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.overall = append(t.overall, [2]int64{current, total})
+}
+
+func (t *testProgress) Error(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errors = append(t.errors, message)
+}
+
+func (t *testProgress) Finished(result *Result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.result = result
+}
+
+// serveFiles starts a server for the named files. http.ServeContent answers
+// HEAD and Range requests as a real bucket would; anything else is a 404.
+func serveFiles(t *testing.T, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testConfig patches a fresh directory from source
+func testConfig(t *testing.T, source string) Config {
+	t.Helper()
+	return Config{Directory: t.TempDir(), Source: source + "/", MaxDownloads: 4}
+}
+
+// runPatcher runs a patch over files and returns its outcome
+func runPatcher(t *testing.T, config Config, files ...string) (*Result, *testProgress) {
+	t.Helper()
+	progress := newTestProgress()
+	result := New(context.Background(), http.DefaultClient, config, Manifest{Files: files}, progress).Run()
+	if result == nil {
+		t.Fatalf("patch did not start: %v", progress.errors)
+	}
+	return result, progress
+}
+
+// fastRetries shortens the retry backoff for the rest of the test
+func fastRetries(t *testing.T) {
+	t.Helper()
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+}
+
+// readFile returns the contents of name in dir, failing the test if it is missing
+func readFile(t *testing.T, dir string, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// exists reports whether name is present in dir
+func exists(dir string, name string) bool {
+	_, err := os.Lstat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func TestRunRemovesExtractedArchivesOnly(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.tar.gz":    tarGz(t, tarEntry{name: "data/a.txt", body: "from the archive"}),
+		"patch-A.MPQ": []byte("MPQ\x1a not an archive"),
+	})
+	config := testConfig(t, server.URL)
+
+	result, _ := runPatcher(t, config, "p.tar.gz", "patch-A.MPQ")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if exists(config.Directory, "p.tar.gz") {
+		t.Error("extracted archive was kept")
+	}
+	if got := readFile(t, config.Directory, "data/a.txt"); got != "from the archive" {
+		t.Errorf("data/a.txt = %q", got)
+	}
+	if got := readFile(t, config.Directory, "patch-A.MPQ"); got != "MPQ\x1a not an archive" {
+		t.Errorf("plain file patch-A.MPQ = %q, want it kept as downloaded", got)
+	}
+}
+
+func TestRunKeepsArchives(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.tar.gz": tarGz(t, tarEntry{name: "a.txt", body: "a"}),
+	})
+
+	t.Run("keep-archives", func(t *testing.T) {
+		config := testConfig(t, server.URL)
+		config.KeepArchives = true
+		if result, _ := runPatcher(t, config, "p.tar.gz"); !result.Success {
+			t.Fatalf("patch failed: %+v", result.Files)
+		}
+		if !exists(config.Directory, "p.tar.gz") {
+			t.Error("archive removed despite KeepArchives")
+		}
+	})
+
+	t.Run("failed extraction", func(t *testing.T) {
+		broken := serveFiles(t, map[string][]byte{
+			"p.tar.gz": append([]byte{0x1f, 0x8b}, "not really gzip"...),
+		})
+		config := testConfig(t, broken.URL)
+		if result, _ := runPatcher(t, config, "p.tar.gz"); result.Success {
+			t.Fatal("patch succeeded with a corrupt archive")
+		}
+		if !exists(config.Directory, "p.tar.gz") {
+			t.Error("archive removed although it failed to extract")
+		}
+	})
+}
+
+func TestNewAppliesDefaults(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{"a.bin": []byte("a"), "b.bin": []byte("b")})
+	// No trailing slash and no download limit, as a library caller might pass
+	config := Config{Directory: t.TempDir(), Source: server.URL}
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin", "b.bin"}}, newTestProgress()).Run()
+	}()
+	select {
+	case result := <-done:
+		if result == nil || !result.Success {
+			t.Fatalf("patch failed: %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return with a zero MaxDownloads")
+	}
+
+	if got := (Config{}).Sources(); len(got) != 1 || got[0] != DefaultSource {
+		t.Errorf("zero config sources = %v, want [%s]", got, DefaultSource)
+	}
+}
+
+func TestPatcherReportsProgress(t *testing.T) {
+	files := map[string][]byte{
+		"one.bin": bytes.Repeat([]byte("1"), 3000),
+		"two.bin": bytes.Repeat([]byte("2"), 5000),
+	}
+	server := serveFiles(t, files)
+	config := testConfig(t, server.URL)
+
+	result, progress := runPatcher(t, config, "one.bin", "two.bin")
+	if !result.Success || result.TotalBytes != 8000 {
+		t.Fatalf("result = %+v, want success with 8000 bytes", result)
+	}
+	if progress.result != result {
+		t.Error("Finished was not called with the result")
+	}
+	for order, name := range []string{"one.bin", "two.bin"} {
+		reported := progress.current[order+1]
+		if len(reported) == 0 || reported[len(reported)-1] != int64(len(files[name])) {
+			t.Errorf("%s progress = %v, want it to end at %d", name, reported, len(files[name]))
+		}
+		if !progress.done[order+1] {
+			t.Errorf("DownloadFinished not called for %s", name)
+		}
+	}
+	last := progress.overall[len(progress.overall)-1]
+	if last != [2]int64{8000, 8000} {
+		t.Errorf("last overall progress = %v, want [8000 8000]", last)
+	}
+}
+
+func TestOverallSpeedSumsActiveDownloads(t *testing.T) {
+	progress := newTestProgress()
+	p := New(context.Background(), http.DefaultClient, Config{}, Manifest{Files: []string{"a.bin", "b.bin", "c.bin"}}, progress)
+
+	p.setSpeed(p.downloads[0], 1000)
+	p.setSpeed(p.downloads[1], 250)
+	p.setSpeed(p.downloads[0], 500)
+	p.setSpeed(p.downloads[2], 4000)
+	p.setSpeed(p.downloads[1], 0)
+	p.setSpeed(p.downloads[0], 0)
+	p.setSpeed(p.downloads[2], 0)
+
+	want := []float64{1000, 1250, 750, 4750, 4500, 4000, 0}
+	if !slices.Equal(progress.speeds, want) {
+		t.Errorf("overall speeds = %v, want %v", progress.speeds, want)
+	}
+}
+
+func TestRunEndsWithOverallSpeedZero(t *testing.T) {
+	files := map[string][]byte{"one.bin": testData(3000), "two.bin": testData(5000)}
+	server := serveFiles(t, files)
+
+	result, progress := runPatcher(t, testConfig(t, server.URL), "one.bin", "two.bin")
+	if !result.Success {
+		t.Fatalf("result = %+v, want success", result)
+	}
+	if len(progress.speeds) == 0 || progress.speeds[len(progress.speeds)-1] != 0 {
+		t.Errorf("overall speeds = %v, want them to end at 0", progress.speeds)
+	}
+}
+
+func TestFetchSizesAsksMirrorsConcurrently(t *testing.T) {
+	files := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte("a"), 100),
+		"b.bin": bytes.Repeat([]byte("b"), 200),
+		"c.bin": bytes.Repeat([]byte("c"), 300),
+	}
+	// The source has none of the files. The mirror holds each HEAD until all
+	// three have arrived, so asking one file at a time would time out.
+	source := serveFiles(t, nil)
+	var arrived sync.WaitGroup
+	arrived.Add(len(files))
+	all := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("%s %s sent before the patch started", r.Method, r.URL.Path)
+		}
+		arrived.Done()
+		select {
+		case <-all:
+		case <-time.After(2 * time.Second):
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(files[r.URL.Path[1:]]))
+	}))
+	t.Cleanup(mirror.Close)
+
+	config := testConfig(t, source.URL)
+	config.Mirrors = []string{mirror.URL + "/"}
+	p := New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin", "b.bin", "c.bin"}}, newTestProgress())
+
+	start := time.Now()
+	sizes := p.fetchSizes()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fetchSizes took %v, want the requests sent together", elapsed)
+	}
+	for i, want := range []int64{100, 200, 300} {
+		if sizes[i] != want || p.downloads[i].total.Load() != want {
+			t.Errorf("file %d size = %d, total = %d, want %d from the mirror", i+1, sizes[i], p.downloads[i].total.Load(), want)
+		}
+	}
+}
+
+// checksumList returns a checksums.txt listing the SHA-256 of each named file
+func checksumList(files map[string][]byte, names ...string) []byte {
+	var list bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&list, "%x  %s\n", sha256.Sum256(files[name]), name)
+	}
+	return list.Bytes()
+}
+
+func TestRunVerifiesChecksums(t *testing.T) {
+	files := map[string][]byte{
+		"listed.bin":   []byte("listed"),
+		"unlisted.bin": []byte("unlisted"),
+	}
+	files["checksums.txt"] = checksumList(files, "listed.bin")
+	config := testConfig(t, serveFiles(t, files).URL)
+
+	result, progress := runPatcher(t, config, "listed.bin", "unlisted.bin")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if result.Files[0].Unverified || !result.Files[1].Unverified {
+		t.Errorf("unverified = %v, %v, want only unlisted.bin", result.Files[0].Unverified, result.Files[1].Unverified)
+	}
+	statuses := progress.statuses[2]
+	if got := statuses[len(statuses)-1]; got != i18n.Tr("status.unverified") {
+		t.Errorf("unlisted.bin status = %q, want %q", got, i18n.Tr("status.unverified"))
+	}
+	var written Result
+	if err := json.Unmarshal([]byte(readFile(t, config.Directory, resultFile)), &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Unverified()) != 1 || written.Unverified()[0].File != "unlisted.bin" {
+		t.Errorf("%s lists %+v as unverified", resultFile, written.Unverified())
+	}
+}
+
+func TestRunRejectsChecksumMismatch(t *testing.T) {
+	fastRetries(t)
+	files := map[string][]byte{"a.bin": []byte("expected")}
+	files["checksums.txt"] = checksumList(files, "a.bin")
+	files["a.bin"] = []byte("tampered")
+	config := testConfig(t, serveFiles(t, files).URL)
+
+	result, progress := runPatcher(t, config, "a.bin")
+	if result.Success || !strings.Contains(result.Files[0].Error, "checksum mismatch") {
+		t.Fatalf("result = %+v, want a checksum mismatch", result.Files)
+	}
+	if progress.failed[1] == nil {
+		t.Error("mismatch not reported to the progress")
+	}
+	for _, name := range []string{"a.bin", "a.bin" + partSuffix} {
+		if exists(config.Directory, name) {
+			t.Errorf("%s kept after a checksum mismatch", name)
+		}
+	}
+}
+
+func TestRunResumesPartLeftByCrash(t *testing.T) {
+	data := testData(100000)
+	files := map[string][]byte{"a.tar.gz": data}
+	files["checksums.txt"] = checksumList(files, "a.tar.gz")
+
+	t.Run("intact", func(t *testing.T) {
+		server, sent, ranges := serveCounted(t, "a.tar.gz", data)
+		checksums := serveFiles(t, map[string][]byte{"checksums.txt": files["checksums.txt"]})
+		config := testConfig(t, server.URL)
+		config.Mirrors = []string{checksums.URL + "/"}
+		// The first half arrived before the crash
+		if err := os.WriteFile(filepath.Join(config.Directory, "a.tar.gz"+partSuffix), data[:50000], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Not an archive, so it stays under its name once verified
+		result, _ := runPatcher(t, config, "a.tar.gz")
+		if !result.Success || result.Files[0].Unverified {
+			t.Fatalf("result = %+v, want a verified success", result.Files)
+		}
+		if got := readFile(t, config.Directory, "a.tar.gz"); got != string(data) {
+			t.Error("resumed file differs from the source")
+		}
+		if ranges.Load() != 1 || sent.Load() != 50000 {
+			t.Errorf("sent %d bytes in %d range requests, want the missing 50000 in one", sent.Load(), ranges.Load())
+		}
+		if exists(config.Directory, "a.tar.gz"+partSuffix) {
+			t.Error(".part left after the download completed")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		fastRetries(t)
+		config := testConfig(t, serveFiles(t, files).URL)
+		// Garbage written before the crash fails the checksum once resumed
+		corrupt := bytes.Repeat([]byte{0xff}, 50000)
+		if err := os.WriteFile(filepath.Join(config.Directory, "a.tar.gz"+partSuffix), corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		result, _ := runPatcher(t, config, "a.tar.gz")
+		if !result.Success {
+			t.Fatalf("patch failed: %+v", result.Files)
+		}
+		if got := readFile(t, config.Directory, "a.tar.gz"); got != string(data) {
+			t.Error("file downloaded after a corrupt .part differs from the source")
+		}
+	})
+}
+
+// serveFailing answers the first failures GETs of a.bin with 503 and then
+// serves it
+func serveFailing(t *testing.T, failures int32) *httptest.Server {
+	t.Helper()
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && gets.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("contents"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSuspendDoesNotUseRetries(t *testing.T) {
+	fastRetries(t)
+	failures := int32(downloadRetries + 2)
+
+	t.Run("awake", func(t *testing.T) {
+		config := testConfig(t, serveFailing(t, failures).URL)
+		if result, _ := runPatcher(t, config, "a.bin"); result.Success {
+			t.Fatal("patch succeeded after more failures than retries")
+		}
+	})
+
+	t.Run("suspended", func(t *testing.T) {
+		// Every failed attempt spans a sleep of a minute
+		var attempts atomic.Int32
+		saved := sleptSince
+		sleptSince = func(time.Time) time.Duration {
+			if attempts.Add(1) <= failures {
+				return time.Minute
+			}
+			return 0
+		}
+		t.Cleanup(func() { sleptSince = saved })
+
+		config := testConfig(t, serveFailing(t, failures).URL)
+		if result, _ := runPatcher(t, config, "a.bin"); !result.Success {
+			t.Fatalf("patch failed after the machine slept: %+v", result.Files)
+		}
+		if got := readFile(t, config.Directory, "a.bin"); got != "contents" {
+			t.Errorf("a.bin = %q", got)
+		}
+	})
+}
+
+func TestSleptSince(t *testing.T) {
+	start := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if slept := sleptSince(start); slept < -time.Second || slept > time.Second {
+		t.Errorf("sleptSince right after start = %v", slept)
+	}
+}
+
+func TestRunRetriesWithBackoff(t *testing.T) {
+	delay := retryDelay
+	retryDelay = 20 * time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+
+	config := testConfig(t, serveFailing(t, int32(downloadRetries)).URL)
+	start := time.Now()
+	result, progress := runPatcher(t, config, "a.bin")
+	if !result.Success {
+		t.Fatalf("patch failed with a retry left: %+v", result.Files)
+	}
+	// 20ms, then 40ms, then 80ms
+	if elapsed, want := time.Since(start), 140*time.Millisecond; elapsed < want {
+		t.Errorf("retries took %v, want at least %v of doubling backoff", elapsed, want)
+	}
+	var want, retries []string
+	for retry := 1; retry <= downloadRetries; retry++ {
+		want = append(want, i18n.Tr("status.retry", retry, downloadRetries))
+	}
+	for _, status := range progress.statuses[1] {
+		if slices.Contains(want, status) {
+			retries = append(retries, status)
+		}
+	}
+	if fmt.Sprint(retries) != fmt.Sprint(want) {
+		t.Errorf("retry statuses %q, want %q", retries, want)
+	}
+}
+
+func TestRunLimitsConcurrentDownloads(t *testing.T) {
+	// Each GET holds its slot a while, so queued files pile up behind the limit
+	var running, most atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".bin") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			now := running.Add(1)
+			defer running.Add(-1)
+			for {
+				seen := most.Load()
+				if now <= seen || most.CompareAndSwap(seen, now) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("contents"))
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+	config.MaxDownloads = 2
+
+	result, _ := runPatcher(t, config, "a.bin", "b.bin", "c.bin", "d.bin", "e.bin", "f.bin")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := most.Load(); got != 2 {
+		t.Errorf("%d downloads ran at once, want the limit of 2", got)
+	}
+}
+
+// serveTruncated serves a.bin with its full Content-Length but drops the
+// connection after sending the first half, as a download killed mid-stream
+func serveTruncated(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(data[:len(data)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFailedDownloadLeavesOnlyPart(t *testing.T) {
+	a := bytes.Repeat([]byte("new "), 10000)
+	config := testConfig(t, serveTruncated(t, a).URL)
+	retries := downloadRetries
+	downloadRetries = 0
+	t.Cleanup(func() { downloadRetries = retries })
+	// The files from the last patch stay in place until a new one is complete
+	if err := os.WriteFile(filepath.Join(config.Directory, "a.bin"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := runPatcher(t, config, "a.bin"); result.Success {
+		t.Fatal("patch succeeded with a truncated download")
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != "old" {
+		t.Errorf("a.bin = %q, want the complete file from before", got)
+	}
+	part, err := os.ReadFile(filepath.Join(config.Directory, "a.bin"+partSuffix))
+	if err != nil || !bytes.Equal(part, a[:len(part)]) || len(part) >= len(a) {
+		t.Errorf("%d bytes kept to resume, want the start of the file (%v)", len(part), err)
+	}
+}
+
+func TestRunDetectsShortDownloads(t *testing.T) {
+	fastRetries(t)
+	a := bytes.Repeat([]byte("new "), 10000)
+
+	t.Run("connection dropped", func(t *testing.T) {
+		retries := downloadRetries
+		downloadRetries = 0
+		t.Cleanup(func() { downloadRetries = retries })
+		result, progress := runPatcher(t, testConfig(t, serveTruncated(t, a).URL), "a.bin")
+		if result.Success {
+			t.Fatal("patch succeeded with a truncated download")
+		}
+		if progress.failed[1] == nil || progress.reasons[1] != i18n.Tr("failed.incomplete") {
+			t.Errorf("bar marked %q (%v), want %q", progress.reasons[1], progress.failed[1], i18n.Tr("failed.incomplete"))
+		}
+	})
+
+	t.Run("ended early", func(t *testing.T) {
+		// The size is only known from HEAD, and the first GET ends cleanly
+		// after half the file, as a proxy cutting the body short would
+		var gets atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/a.bin" {
+				http.NotFound(w, r)
+				return
+			}
+			if r.Method == http.MethodGet && gets.Add(1) == 1 {
+				w.Write(a[:len(a)/2])
+				w.(http.Flusher).Flush()
+				return
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(a))
+		}))
+		t.Cleanup(server.Close)
+		config := testConfig(t, server.URL)
+
+		progress := newTestProgress()
+		var reasons []string
+		result := New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin"}}, reasonRecorder{progress, &reasons}).Run()
+		if result == nil || !result.Success {
+			t.Fatalf("patch failed after the retry: %+v", result)
+		}
+		if !slices.Contains(reasons, i18n.Tr("failed.incomplete")) {
+			t.Errorf("short download reported as %q, want %q", reasons, i18n.Tr("failed.incomplete"))
+		}
+		if got := gets.Load(); got != 2 {
+			t.Errorf("a.bin fetched %d times, want a single retry", got)
+		}
+		if got := readFile(t, config.Directory, "a.bin"); got != string(a) {
+			t.Errorf("a.bin has %d bytes after resuming, want %d", len(got), len(a))
+		}
+	})
+}
+
+// reasonRecorder keeps every failure reason, which testProgress forgets once
+// a retry clears the failure
+type reasonRecorder struct {
+	*testProgress
+	reasons *[]string
+}
+
+func (r reasonRecorder) FileFailed(order int, reason string, err error) {
+	r.mu.Lock()
+	*r.reasons = append(*r.reasons, reason)
+	r.mu.Unlock()
+	r.testProgress.FileFailed(order, reason, err)
+}
+
+// BenchmarkReadBuffer downloads an 8 MiB file with the 1 KiB reads the patcher
+// started with and with bufferSize
+func BenchmarkReadBuffer(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 512*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	for _, size := range []int{1024, bufferSize} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			saved := bufferSize
+			bufferSize = size
+			defer func() { bufferSize = saved }()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				config := Config{Directory: b.TempDir(), Source: server.URL + "/"}
+				result := New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin"}}, newTestProgress()).Run()
+				if result == nil || !result.Success {
+					b.Fatalf("download failed: %+v", result)
+				}
+			}
+		})
+	}
+}
+
+func TestRunSkipsFilesMatchingChecksum(t *testing.T) {
+	files := map[string][]byte{"same.MPQ": []byte("MPQ\x1a same"), "stale.MPQ": []byte("MPQ\x1a new")}
+	files["checksums.txt"] = checksumList(files, "same.MPQ", "stale.MPQ")
+	server, gets := serveGets(t, files)
+	config := testConfig(t, server.URL)
+	for name, data := range map[string]string{"same.MPQ": "MPQ\x1a same", "stale.MPQ": "MPQ\x1a old"} {
+		if err := os.WriteFile(filepath.Join(config.Directory, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, progress := runPatcher(t, config, "same.MPQ", "stale.MPQ")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if gets("same.MPQ") != 0 || gets("stale.MPQ") != 1 {
+		t.Errorf("fetched same.MPQ %d and stale.MPQ %d times, want 0 and 1", gets("same.MPQ"), gets("stale.MPQ"))
+	}
+	if !slices.Contains(progress.statuses[1], i18n.Tr("status.upToDate")) {
+		t.Errorf("same.MPQ statuses %q, want it shown up to date", progress.statuses[1])
+	}
+	if got := readFile(t, config.Directory, "stale.MPQ"); got != "MPQ\x1a new" {
+		t.Errorf("stale.MPQ = %q", got)
+	}
+}
+
+func TestRunWaitsForEveryDownload(t *testing.T) {
+	files := map[string][]byte{"fast.bin": []byte("fast"), "slow.bin": []byte("slow")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.bin" && r.Method == http.MethodGet {
+			time.Sleep(200 * time.Millisecond)
+		}
+		data, ok := files[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	config := testConfig(t, server.URL)
+	result, progress := runPatcher(t, config, "fast.bin", "slow.bin")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+	for order, name := range []string{"fast.bin", "slow.bin"} {
+		if !progress.done[order+1] {
+			t.Errorf("Run returned before %s finished", name)
+		}
+		if got := readFile(t, config.Directory, name); got != string(files[name]) {
+			t.Errorf("%s = %q", name, got)
+		}
+	}
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	server, started := serveUntil(t, "a.bin", testData(64*1024), 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	config := testConfig(t, server.URL)
+	done := make(chan *Result, 1)
+	go func() {
+		done <- New(ctx, http.DefaultClient, config, Manifest{Files: []string{"a.bin"}}, newTestProgress()).Run()
+	}()
+
+	<-started
+	cancel()
+	result := waitResult(t, done)
+	if result.Success || result.Files[0].Success {
+		t.Errorf("cancelled patch succeeded: %+v", result.Files)
+	}
+	if !strings.Contains(result.Files[0].Error, context.Canceled.Error()) {
+		t.Errorf("a.bin failed with %q, want the cancellation", result.Files[0].Error)
+	}
+}
+
+func TestCancelOneOfSeveralDownloads(t *testing.T) {
+	hd := tarGz(t, tarEntry{name: "hd.txt", body: string(testData(256 * 1024))})
+	server, _ := servePausable(t, map[string][]byte{
+		"hd.tar.gz": hd,
+		"a.bin":     []byte("a"),
+		"b.tar.gz":  tarGz(t, tarEntry{name: "b.txt", body: "b"}),
+	}, "hd.tar.gz")
+	config := testConfig(t, server.URL)
+
+	p, progress, done := startPatcher(t, config, "hd.tar.gz", "a.bin", "b.tar.gz")
+	waitFor(t, "half of hd.tar.gz", func() bool { return hasPart(config.Directory, "hd.tar.gz", len(hd)/2) })
+	p.Cancel(1)
+
+	result := waitResult(t, done)
+	if !result.Success {
+		t.Errorf("patch failed with a cancelled download: %+v", result.Files)
+	}
+	if !result.Files[0].Skipped || result.Files[0].Error != "" {
+		t.Errorf("hd.tar.gz = %+v, want it skipped", result.Files[0])
+	}
+	if exists(config.Directory, "hd.tar.gz"+partSuffix) || exists(config.Directory, "hd.tar.gz") || exists(config.Directory, "hd.txt") {
+		t.Error("cancelled hd.tar.gz left files behind")
+	}
+	progress.mu.Lock()
+	statuses := progress.statuses[1]
+	progress.mu.Unlock()
+	if len(statuses) == 0 || statuses[len(statuses)-1] != i18n.Tr("status.cancelled") {
+		t.Errorf("hd.tar.gz statuses %q, want it shown cancelled", statuses)
+	}
+	for i, name := range []string{"a.bin", "b.txt"} {
+		if !result.Files[i+1].Success || !exists(config.Directory, name) {
+			t.Errorf("%s not patched alongside the cancelled download: %+v", name, result.Files[i+1])
+		}
+	}
+}
+
+// openFiles returns the files under dir the test process has open, or false
+// where the open files cannot be listed
+func openFiles(t *testing.T, dir string) ([]string, bool) {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil, false
+	}
+	var open []string
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, dir) {
+			open = append(open, target)
+		}
+	}
+	return open, true
+}
+
+func TestCancelledRunClosesFiles(t *testing.T) {
+	data := testData(64 * 1024)
+	server, started := serveUntil(t, "a.bin", data, 16*1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	config := testConfig(t, server.URL)
+	done := make(chan *Result, 1)
+	go func() {
+		done <- New(ctx, http.DefaultClient, config, Manifest{Files: []string{"a.bin"}}, newTestProgress()).Run()
+	}()
+
+	<-started
+	waitFor(t, "the first bytes", func() bool {
+		info, err := os.Stat(filepath.Join(config.Directory, "a.bin"+partSuffix))
+		return err == nil && info.Size() > 0
+	})
+	cancel()
+	if result := waitResult(t, done); result.Success {
+		t.Fatal("interrupted patch succeeded")
+	}
+
+	if open, ok := openFiles(t, config.Directory); ok && len(open) != 0 {
+		t.Errorf("files left open after the interrupt: %q", open)
+	}
+	// Nothing half written takes the file's name; the .part stays for the
+	// next run to resume
+	if exists(config.Directory, "a.bin") {
+		t.Error("incomplete a.bin left in place")
+	}
+	part, err := os.ReadFile(filepath.Join(config.Directory, "a.bin"+partSuffix))
+	if err != nil || len(part) == 0 || !bytes.Equal(part, data[:len(part)]) {
+		t.Errorf("%d bytes kept to resume, want the start of the file (%v)", len(part), err)
+	}
+}
@@ -0,0 +1,78 @@
+package patch
+
+import (
+	"context"
+	"errors"
+)
+
+var errPaused = errors.New("download paused")
+
+// errCancelled stops a single download the player chose to skip
+var errCancelled = errors.New("download cancelled")
+
+// stopped reports whether err is a pause or cancel the player asked for rather
+// than a failure
+func stopped(err error) bool {
+	return errors.Is(err, errPaused) || errors.Is(err, errCancelled)
+}
+
+// togglePause pauses or resumes the download and returns whether it is now
+// paused. Pausing cancels the running attempt; on resume the download picks up
+// from the bytes already written.
+func (d *download) togglePause() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.paused {
+		d.paused = false
+		close(d.resumed)
+		return false
+	}
+
+	d.paused = true
+	d.resumed = make(chan struct{})
+	if d.stop != nil {
+		d.stop(errPaused)
+	}
+	return true
+}
+
+// begin registers the cancel func of a new attempt so a pause can stop it. It
+// returns false if the download is paused and the attempt should not start.
+func (d *download) begin(stop context.CancelCauseFunc) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.paused {
+		return false
+	}
+	d.stop = stop
+	return true
+}
+
+// end clears the cancel func once an attempt has finished
+func (d *download) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stop = nil
+}
+
+// waitForResume blocks while the download is paused, returning early if ctx is
+// cancelled so a paused download never outlives the run
+func (d *download) waitForResume(ctx context.Context) error {
+	d.mu.Lock()
+	paused, resumed := d.paused, d.resumed
+	d.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
@@ -0,0 +1,123 @@
+package patch
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// servePausable serves files, holding the first GET of each held file open
+// after half of it until the client goes away, as a download being paused or
+// cancelled would be. The returned func lists the Range headers of the GET
+// requests for a file.
+func servePausable(t *testing.T, files map[string][]byte, held ...string) (*httptest.Server, func(name string) []string) {
+	t.Helper()
+	var mu sync.Mutex
+	ranges := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[1:]
+		data, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if slices.Contains(held, name) && r.Method == http.MethodGet {
+			mu.Lock()
+			ranges[name] = append(ranges[name], r.Header.Get("Range"))
+			first := len(ranges[name]) == 1
+			mu.Unlock()
+			if first {
+				w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+				w.Write(data[:len(data)/2])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server, func(name string) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges[name]...)
+	}
+}
+
+// hasPart reports whether size bytes of file have been written to its .part
+func hasPart(dir string, file string, size int) bool {
+	info, err := os.Stat(filepath.Join(dir, file+partSuffix))
+	return err == nil && info.Size() == int64(size)
+}
+
+func TestPauseResumesFromWrittenBytes(t *testing.T) {
+	a := testData(64 * 1024)
+	server, ranges := servePausable(t, map[string][]byte{"a.bin": a}, "a.bin")
+	config := testConfig(t, server.URL)
+
+	p, _, done := startPatcher(t, config, "a.bin")
+	waitFor(t, "half of a.bin", func() bool { return hasPart(config.Directory, "a.bin", len(a)/2) })
+	if !p.TogglePause(1) {
+		t.Fatal("TogglePause did not pause")
+	}
+	select {
+	case <-done:
+		t.Fatal("patch finished while a download was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if p.TogglePause(1) {
+		t.Fatal("TogglePause did not resume")
+	}
+
+	result := waitResult(t, done)
+	if !result.Success {
+		t.Fatalf("patch failed after resuming: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "a.bin"); got != string(a) {
+		t.Errorf("a.bin has %d bytes, want %d", len(got), len(a))
+	}
+	want := []string{"", fmt.Sprintf("bytes=%d-", len(a)/2)}
+	if got := ranges("a.bin"); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("requests asked for %q, want %q", got, want)
+	}
+}
+
+func TestPausedDownloadFreesItsSlot(t *testing.T) {
+	files := map[string][]byte{"a.bin": testData(64 * 1024), "b.bin": testData(32 * 1024)}
+	server, _ := servePausable(t, files, "a.bin", "b.bin")
+	config := testConfig(t, server.URL)
+	config.MaxDownloads = 1
+	p, _, done := startPatcher(t, config, "a.bin", "b.bin")
+	started := func(name string) bool { return hasPart(config.Directory, name, len(files[name])/2) }
+
+	// Whichever file took the only slot is paused, after which the other one
+	// can only start in the slot it gave up
+	var first, second int
+	waitFor(t, "a download to start", func() bool { return started("a.bin") || started("b.bin") })
+	if first, second = 1, 2; started("b.bin") {
+		first, second = 2, 1
+	}
+	p.TogglePause(first)
+	waitFor(t, "the queued download to start", func() bool { return started(p.files[second-1]) })
+
+	// Each one resumed in turn takes the slot and completes
+	p.TogglePause(second)
+	p.TogglePause(first)
+	p.TogglePause(second)
+	result := waitResult(t, done)
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	for name, data := range files {
+		if got := readFile(t, config.Directory, name); got != string(data) {
+			t.Errorf("%s has %d bytes, want %d", name, len(got), len(data))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package patch
+
+import (
+	"log/slog"
+	"os"
+)
+
+// What a run would do with a file, see Plan
+const (
+	ActionDownload  = "download"
+	ActionOverwrite = "overwrite"
+	ActionSkip      = "skip"
+)
+
+// FilePlan is the planned action for one file of the patch
+type FilePlan struct {
+	File   string
+	Action string
+	// Bytes to download, or the size of the local copy when skipped; -1 if unknown
+	Size int64
+}
+
+// Plan works out what Run would do without writing anything: files already
+// matching their checksum are skipped, other local copies are overwritten and
+// missing files are downloaded. Deltas that apply count their patch's size.
+func (p *Patcher) Plan() []FilePlan {
+	checksums, err := FetchChecksums(p.ctx, p.client, p.sources())
+	if err != nil {
+		slog.Warn("Unable to fetch checksums, local files cannot be compared", "err", err)
+	}
+	p.checksums = checksums
+
+	var plan []FilePlan
+	if p.upToDateVersion() {
+		for _, file := range p.files {
+			plan = append(plan, FilePlan{File: file, Action: ActionSkip, Size: -1})
+		}
+		return plan
+	}
+
+	p.checkDeltas()
+	for _, download := range p.downloads {
+		file := download.file
+		path := p.directory + "/" + file
+
+		if expected, ok := p.checksums[file]; ok {
+			if sum, size, err := fileChecksum(path); err == nil && sum == expected {
+				plan = append(plan, FilePlan{File: file, Action: ActionSkip, Size: size})
+				continue
+			}
+		}
+
+		// A delta only downloads its patch
+		size, err := headSizeFrom(p.ctx, p.client, p.sources(), p.remoteName(download))
+		if err != nil {
+			slog.Warn("Unable to get file size", "file", file, "err", err)
+			size = -1
+		}
+
+		action := ActionDownload
+		if _, err := os.Stat(path); err == nil {
+			action = ActionOverwrite
+		}
+		plan = append(plan, FilePlan{File: file, Action: action, Size: size})
+	}
+	return plan
+}
@@ -0,0 +1,93 @@
+package patch
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// snapshot returns the contents and modification time of every file in dir
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		files[path] = string(data) + "@" + info.ModTime().Format(time.RFC3339Nano)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPlanTouchesNothing(t *testing.T) {
+	files := map[string][]byte{
+		"same.MPQ":   []byte("MPQ\x1a same"),
+		"stale.MPQ":  []byte("MPQ\x1a new contents"),
+		"new.tar.gz": tarGz(t, tarEntry{name: "data/a.txt", body: "a"}),
+	}
+	files["checksums.txt"] = checksumList(files, "same.MPQ", "stale.MPQ", "new.tar.gz")
+	server, gets := serveGets(t, files)
+	config := testConfig(t, server.URL)
+	for name, data := range map[string]string{"same.MPQ": "MPQ\x1a same", "stale.MPQ": "MPQ\x1a old"} {
+		if err := os.WriteFile(filepath.Join(config.Directory, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := snapshot(t, config.Directory)
+
+	manifest := Manifest{Files: []string{"same.MPQ", "stale.MPQ", "new.tar.gz"}, Version: "v2"}
+	plan := New(context.Background(), http.DefaultClient, config, manifest, nil).Plan()
+	want := []FilePlan{
+		{File: "same.MPQ", Action: ActionSkip, Size: int64(len(files["same.MPQ"]))},
+		{File: "stale.MPQ", Action: ActionOverwrite, Size: int64(len(files["stale.MPQ"]))},
+		{File: "new.tar.gz", Action: ActionDownload, Size: int64(len(files["new.tar.gz"]))},
+	}
+	if len(plan) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", plan, want)
+	}
+	for i := range want {
+		if plan[i] != want[i] {
+			t.Errorf("plan[%d] = %+v, want %+v", i, plan[i], want[i])
+		}
+	}
+
+	after := snapshot(t, config.Directory)
+	if len(after) != len(before) {
+		t.Errorf("dry run left %d files, want %d", len(after), len(before))
+	}
+	for path, state := range before {
+		if after[path] != state {
+			t.Errorf("dry run changed %s", path)
+		}
+	}
+	for _, file := range manifest.Files {
+		if got := gets(file); got != 0 {
+			t.Errorf("dry run fetched %s %d times", file, got)
+		}
+	}
+}
+
+func TestPlanSkipsCurrentVersion(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{"a.bin": []byte("a")})
+	config := testConfig(t, server.URL)
+	if err := writeVersion(config.Directory, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	plan := New(context.Background(), http.DefaultClient, config, Manifest{Files: []string{"a.bin", "b.bin"}, Version: "v1"}, nil).Plan()
+	if len(plan) != 2 {
+		t.Fatalf("plan = %+v", plan)
+	}
+	for _, file := range plan {
+		if file.Action != ActionSkip {
+			t.Errorf("%s planned as %s at the installed version", file.File, file.Action)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package patch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterCapsCombinedRate(t *testing.T) {
+	const rate = 400 * 1024
+	limiter := newRateLimiter(rate)
+
+	// Two downloads share the cap: with a second of data in the bucket,
+	// 600 KiB between them takes at least half a second more
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, limiter.reader(context.Background(), bytes.NewReader(make([]byte, 300*1024))))
+			if err != nil || n != 300*1024 {
+				t.Errorf("read %d bytes: %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("600 KiB at 400 KiB/s took %v, want about half a second", elapsed)
+	}
+}
+
+func TestRateLimiterReads(t *testing.T) {
+	// Reads are cut to a tenth of a second of data so none waits long
+	limiter := newRateLimiter(100 * 1024)
+	buf := make([]byte, 256*1024)
+	if n, _ := limiter.reader(context.Background(), bytes.NewReader(buf)).Read(buf); n != 10*1024 {
+		t.Errorf("read %d bytes at once, want %d", n, 10*1024)
+	}
+
+	unlimited := newRateLimiter(0)
+	start := time.Now()
+	if n, _ := io.Copy(io.Discard, unlimited.reader(context.Background(), bytes.NewReader(make([]byte, 8<<20)))); n != 8<<20 {
+		t.Errorf("read %d bytes without a cap", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("8 MiB without a cap took %v", elapsed)
+	}
+}
+
+func TestRateLimiterStopsWaitingWhenCancelled(t *testing.T) {
+	limiter := newRateLimiter(1024)
+	// Empties the bucket, so the next read has to wait for a second of tokens
+	if err := limiter.wait(context.Background(), 1024); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.wait(ctx, 1024); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled wait took %v", elapsed)
+	}
+}
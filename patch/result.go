@@ -0,0 +1,140 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// Name of the summary file written to the output directory after each run
+var resultFile = "patch-result.json"
+
+// Result summarizes a complete run for launchers and support tools
+type Result struct {
+	// Manifest version the run applied or found installed, empty if the
+	// manifest does not name one
+	Version    string    `json:"version,omitempty"`
+	Success    bool      `json:"success"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Duration   float64   `json:"durationSeconds"`
+	TotalBytes int64     `json:"totalBytes"`
+	UpToDate   bool      `json:"upToDate,omitempty"`
+	// Run with Config.Repair
+	Repair bool         `json:"repair,omitempty"`
+	Files  []FileResult `json:"files"`
+}
+
+// FileResult is the outcome of downloading and extracting a single file
+type FileResult struct {
+	File     string  `json:"file"`
+	Success  bool    `json:"success"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"durationSeconds"`
+	Error    string  `json:"error,omitempty"`
+	// Cancelled by the player, which does not make the patch fail
+	Skipped bool `json:"skipped,omitempty"`
+	// Applied without being checked, as checksums.txt was missing or had no
+	// checksum for the file
+	Unverified bool `json:"unverified,omitempty"`
+	// Found intact by a repair, so it was neither downloaded nor applied again
+	Intact bool `json:"intact,omitempty"`
+}
+
+func newResult(version string, count int) *Result {
+	return &Result{
+		Version:   version,
+		StartedAt: time.Now(),
+		Files:     make([]FileResult, count),
+	}
+}
+
+func newFileResult(file string, bytes int64, duration time.Duration, err error) FileResult {
+	result := FileResult{
+		File:     file,
+		Success:  true,
+		Bytes:    bytes,
+		Duration: duration.Seconds(),
+	}
+	if errors.Is(err, errCancelled) {
+		result.Success = false
+		result.Skipped = true
+	} else if err != nil {
+		result.fail(err)
+	}
+	return result
+}
+
+func (f *FileResult) fail(err error) {
+	f.Success = false
+	f.Error = err.Error()
+}
+
+// finish tallies the per-file results into the overall outcome
+func (r *Result) finish() {
+	r.FinishedAt = time.Now()
+	r.Duration = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Success = true
+	r.TotalBytes = 0
+	for _, file := range r.Files {
+		r.TotalBytes += file.Bytes
+		if !file.Success && !file.Skipped {
+			r.Success = false
+		}
+	}
+}
+
+// Failures returns the files that were not downloaded and extracted
+// successfully, leaving out the ones the player cancelled
+func (r *Result) Failures() []FileResult {
+	var failed []FileResult
+	for _, file := range r.Files {
+		if !file.Success && !file.Skipped {
+			failed = append(failed, file)
+		}
+	}
+	return failed
+}
+
+// Unverified returns the files that were applied without a checksum to check
+// them against
+func (r *Result) Unverified() []FileResult {
+	var unverified []FileResult
+	for _, file := range r.Files {
+		if file.Unverified {
+			unverified = append(unverified, file)
+		}
+	}
+	return unverified
+}
+
+// Repaired returns the files a repair found missing or damaged and applied again
+func (r *Result) Repaired() []FileResult {
+	var repaired []FileResult
+	for _, file := range r.Files {
+		if r.Repair && file.Success && !file.Intact {
+			repaired = append(repaired, file)
+		}
+	}
+	return repaired
+}
+
+// skipped reports whether any file was cancelled and so not applied
+func (r *Result) skipped() bool {
+	for _, file := range r.Files {
+		if file.Skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// write saves the result to the output directory, replacing any previous run
+func (r *Result) write(directory string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(directory+"/"+resultFile, data, 0644)
+}
@@ -0,0 +1,286 @@
+package patch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files of at least segmentThreshold bytes are fetched as this many byte
+// ranges at once when the server supports it
+var segments = 4
+var segmentThreshold int64 = 64 * 1024 * 1024
+
+// segmentable reports whether a fresh download should be split into ranges:
+// the file is large, its size is known and the server accepts Range requests
+func segmentable(resp *http.Response, total int64) bool {
+	return segments > 1 && total >= segmentThreshold &&
+		resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// segmentState records how far each range of a segmented download got. It is
+// kept next to the .part file so a later attempt, or the next run, fetches
+// only the bytes that are missing rather than the whole file again.
+type segmentState struct {
+	mu       sync.Mutex
+	Total    int64          `json:"total"`
+	Segments []segmentRange `json:"segments"`
+}
+
+// segmentRange is bytes Start to End (inclusive) of the file, written up to
+// but not including Next
+type segmentRange struct {
+	Start int64 `json:"start"`
+	Next  int64 `json:"next"`
+	End   int64 `json:"end"`
+}
+
+// Suffix of the segment state saved next to a .part file
+var segmentsSuffix = ".segments"
+
+// errSegmentsChanged means the file on the server no longer has the size the
+// saved ranges were made for, so they cannot be resumed
+var errSegmentsChanged = errors.New("file changed on the server since the download started")
+
+// newSegmentState splits a file of total bytes into equal ranges, the last
+// taking the remainder
+func newSegmentState(total int64) *segmentState {
+	state := &segmentState{Total: total}
+	size := total / int64(segments)
+	for i := 0; i < segments; i++ {
+		start := int64(i) * size
+		end := start + size - 1
+		if i == segments-1 {
+			end = total - 1
+		}
+		state.Segments = append(state.Segments, segmentRange{Start: start, Next: start, End: end})
+	}
+	return state
+}
+
+// loadSegmentState reads the state saved for the .part at path, or returns
+// nil if there is none or it cannot be used
+func loadSegmentState(path string) *segmentState {
+	data, err := os.ReadFile(path + segmentsSuffix)
+	if err != nil {
+		return nil
+	}
+	var state segmentState
+	if err := json.Unmarshal(data, &state); err != nil || state.Total <= 0 || len(state.Segments) == 0 {
+		slog.Warn("Ignoring invalid segment state", "path", path+segmentsSuffix, "err", err)
+		return nil
+	}
+	return &state
+}
+
+// save writes the state next to the .part at path. It goes through a
+// temporary file so a crash never leaves half of it behind.
+func (s *segmentState) save(path string) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + segmentsSuffix + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+segmentsSuffix)
+}
+
+// advance records n more bytes written to segment i
+func (s *segmentState) advance(i int, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Segments[i].Next += n
+}
+
+// written returns the bytes already in the file across every range
+func (s *segmentState) written() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var written int64
+	for _, segment := range s.Segments {
+		written += segment.Next - segment.Start
+	}
+	return written
+}
+
+// downloadSegmented fetches a file as several byte ranges at once, writing
+// each into its place in a preallocated .part file. A fresh download reads the
+// first range from resp, which already streams the file from the start, and
+// requests the others; resuming from a saved state passes a nil resp and every
+// unfinished range is requested from where it stopped. All of them count
+// towards the file's single progress bar. Cancelling ctx stops every range,
+// so pauses and stalls work as for a single stream, and the state is saved
+// as the ranges progress and when they stop.
+func (p *Patcher) downloadSegmented(ctx context.Context, stall *time.Timer, resp *http.Response, source string, file string, order int, state *segmentState) error {
+	path := p.directory + "/" + file + partSuffix
+	download := p.downloads[order-1]
+
+	flags := os.O_RDWR
+	if resp != nil {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	out, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		slog.Error("Unable to create file", "path", path, "err", err)
+		return err
+	}
+	defer out.Close()
+	if resp != nil {
+		if err := out.Truncate(state.Total); err != nil {
+			return err
+		}
+	}
+	if err := state.save(path); err != nil {
+		return err
+	}
+
+	download.total.Store(state.Total)
+	download.current.Store(state.written())
+	p.refresh(download)
+	slog.Debug("Downloading in segments", "file", file, "segments", len(state.Segments), "bytes", state.Total, "written", state.written())
+	started := time.Now()
+
+	// The first failing range stops the others
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(state.Segments))
+	for i, segment := range state.Segments {
+		if segment.Next > segment.End {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.downloadSegment(ctx, stall, resp, download, i, source, out, state)
+			if errs[i] != nil {
+				cancel(errs[i])
+			}
+		}(i)
+	}
+
+	p.watchSegments(&wg, download, state, path)
+
+	for _, err := range errs {
+		if err != nil {
+			err = downloadError(ctx, err)
+			if errors.Is(err, errSegmentsChanged) {
+				removePartial(path)
+			}
+			if !stopped(err) {
+				slog.Error("Download interrupted", "file", file, "source", source, "bytes", download.current.Load(), "err", err)
+			}
+			return err
+		}
+	}
+
+	os.Remove(path + segmentsSuffix)
+	slog.Info("Downloaded", "file", file, "source", source, "bytes", state.Total, "segments", len(state.Segments), "duration", time.Since(started))
+	return nil
+}
+
+// downloadSegment copies the unwritten bytes of segment i into out. The first
+// range of a fresh download reads from resp; the others request their part.
+func (p *Patcher) downloadSegment(ctx context.Context, stall *time.Timer, resp *http.Response, download *download, i int, source string, out *os.File, state *segmentState) error {
+	file := download.file
+	state.mu.Lock()
+	segment := state.Segments[i]
+	state.mu.Unlock()
+
+	var body io.Reader
+	if i == 0 && resp != nil {
+		body = io.LimitReader(resp.Body, segment.End-segment.Next+1)
+	} else {
+		rangeResp, err := requestRange(ctx, p.client, source, file, segment.Next, segment.End)
+		if err != nil {
+			return err
+		}
+		defer rangeResp.Body.Close()
+		if contentRangeTotal(rangeResp, segment.Next) != state.Total {
+			return errSegmentsChanged
+		}
+		body = rangeResp.Body
+	}
+	body = p.limiter.reader(ctx, body)
+
+	position := segment.Next
+	buf := make([]byte, bufferSize)
+	for position <= segment.End {
+		n, err := body.Read(buf)
+		if n > 0 {
+			stall.Reset(stallTimeout)
+			if _, err := out.WriteAt(buf[:n], position); err != nil {
+				return err
+			}
+			position += int64(n)
+			state.advance(i, int64(n))
+			download.current.Add(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if position != segment.End+1 {
+		return fmt.Errorf("incomplete download of %s: segment %d got %d of %d bytes", file, i+1, position-segment.Start, segment.End-segment.Start+1)
+	}
+	return nil
+}
+
+// watchSegments redraws the file's bar and speed from the shared counter
+// until every segment has finished, saving the state of the .part at path
+// once a second and at the end
+func (p *Patcher) watchSegments(wg *sync.WaitGroup, download *download, state *segmentState, path string) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(uiUpdateInterval)
+	defer ticker.Stop()
+
+	lastTime := time.Now()
+	lastBytes := download.current.Load()
+	smoothed := 0.0
+	for {
+		select {
+		case <-done:
+			p.refresh(download)
+			if err := state.save(path); err != nil {
+				slog.Error("Unable to save segment state", "path", path, "err", err)
+			}
+			return
+		case now := <-ticker.C:
+			p.refresh(download)
+			elapsed := now.Sub(lastTime).Seconds()
+			if elapsed < 1 {
+				continue
+			}
+			if err := state.save(path); err != nil {
+				slog.Error("Unable to save segment state", "path", path, "err", err)
+			}
+			current := download.current.Load()
+			smoothed = smoothSpeed(smoothed, float64(current-lastBytes)/elapsed)
+			p.progress.FileSpeed(download.order, smoothed, state.Total-current)
+			p.setSpeed(download, smoothed)
+			lastBytes = current
+			lastTime = now
+		}
+	}
+}
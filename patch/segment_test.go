@@ -0,0 +1,213 @@
+package patch
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingWriter counts the body bytes a handler sends
+type countingWriter struct {
+	http.ResponseWriter
+	sent *atomic.Int64
+}
+
+func (w countingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.sent.Add(int64(n))
+	return n, err
+}
+
+// serveCounted serves data as name, counting the body bytes sent and the
+// Range requests made
+func serveCounted(t *testing.T, name string, data []byte) (server *httptest.Server, sent *atomic.Int64, ranges *atomic.Int64) {
+	t.Helper()
+	sent, ranges = new(atomic.Int64), new(atomic.Int64)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path[1:] != name {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(countingWriter{w, sent}, r, name, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server, sent, ranges
+}
+
+// segmentedFiles splits files of at least threshold bytes for the rest of the test
+func segmentedFiles(t *testing.T, threshold int64) {
+	t.Helper()
+	saved := segmentThreshold
+	segmentThreshold = threshold
+	t.Cleanup(func() { segmentThreshold = saved })
+}
+
+// testData returns size bytes that differ from one position to the next, so
+// a range written in the wrong place shows
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	return data
+}
+
+func TestSegmentedDownloadMatchesSource(t *testing.T) {
+	segmentedFiles(t, 1000)
+	data := testData(300000)
+	server, _, ranges := serveCounted(t, "big.bin", data)
+	config := testConfig(t, server.URL)
+
+	if result, _ := runPatcher(t, config, "big.bin"); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "big.bin"); got != string(data) {
+		t.Error("segmented download differs from the source")
+	}
+	if got := ranges.Load(); got != int64(segments-1) {
+		t.Errorf("%d range requests, want %d", got, segments-1)
+	}
+	if exists(config.Directory, "big.bin"+partSuffix+segmentsSuffix) {
+		t.Error("segment state left behind")
+	}
+}
+
+func TestSegmentedDownloadResumes(t *testing.T) {
+	segmentedFiles(t, 1000)
+	data := testData(400000)
+	server, sent, _ := serveCounted(t, "big.bin", data)
+	config := testConfig(t, server.URL)
+
+	// A preallocated .part with the first half of every range written, as an
+	// interrupted segmented download leaves it
+	part := filepath.Join(config.Directory, "big.bin"+partSuffix)
+	state := newSegmentState(int64(len(data)))
+	written := make([]byte, len(data))
+	for i, segment := range state.Segments {
+		half := (segment.End - segment.Start + 1) / 2
+		copy(written[segment.Start:], data[segment.Start:segment.Start+half])
+		state.Segments[i].Next = segment.Start + half
+	}
+	if err := os.WriteFile(part, written, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(part); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := runPatcher(t, config, "big.bin"); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "big.bin"); got != string(data) {
+		t.Error("resumed download differs from the source")
+	}
+	if got, want := sent.Load(), int64(len(data)-len(data)/2); got != want {
+		t.Errorf("resume fetched %d bytes, want the %d missing", got, want)
+	}
+	for _, name := range []string{"big.bin" + partSuffix, "big.bin" + partSuffix + segmentsSuffix} {
+		if exists(config.Directory, name) {
+			t.Errorf("%s left behind", name)
+		}
+	}
+}
+
+func TestSegmentedDownloadRestartsWhenFileChanged(t *testing.T) {
+	segmentedFiles(t, 1000)
+	fastRetries(t)
+	data := testData(200000)
+	server, _, _ := serveCounted(t, "big.bin", data)
+	config := testConfig(t, server.URL)
+
+	// State saved for an older, larger version of the file
+	part := filepath.Join(config.Directory, "big.bin"+partSuffix)
+	if err := os.WriteFile(part, make([]byte, 250000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := newSegmentState(250000)
+	state.Segments[0].Next = 1000
+	if err := state.save(part); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := runPatcher(t, config, "big.bin"); !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "big.bin"); got != string(data) {
+		t.Error("download after a changed file differs from the source")
+	}
+}
+
+func TestSegmentedProgressIsMonotonic(t *testing.T) {
+	segmentedFiles(t, 1000)
+	data := testData(600000)
+	// The first range, read from the initial response, only arrives once
+	// every other range has been served, so the ranges finish out of order
+	var served atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/big.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			deadline := time.Now().Add(5 * time.Second)
+			for served.Load() < int64(segments-1) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			w.Write(data)
+			return
+		}
+		http.ServeContent(w, r, "big.bin", time.Time{}, bytes.NewReader(data))
+		if r.Header.Get("Range") != "" {
+			served.Add(1)
+		}
+	}))
+	t.Cleanup(server.Close)
+	config := testConfig(t, server.URL)
+
+	result, progress := runPatcher(t, config, "big.bin")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if got := readFile(t, config.Directory, "big.bin"); got != string(data) {
+		t.Error("segmented download differs from the source")
+	}
+
+	// Extraction reports from 0 again once the download is complete
+	total := int64(len(data))
+	reported := progress.current[1]
+	for i, current := range reported {
+		if current == total {
+			reported = reported[:i+1]
+			break
+		}
+	}
+	for i := 1; i < len(reported); i++ {
+		if reported[i] < reported[i-1] {
+			t.Fatalf("file progress went back from %d to %d", reported[i-1], reported[i])
+		}
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != total {
+		t.Errorf("file progress ends at %v, want %d", reported, total)
+	}
+	for i := 1; i < len(progress.overall); i++ {
+		if progress.overall[i][0] < progress.overall[i-1][0] {
+			t.Fatalf("overall progress went back from %d to %d", progress.overall[i-1][0], progress.overall[i][0])
+		}
+	}
+	if last := progress.overall[len(progress.overall)-1]; last != [2]int64{total, total} {
+		t.Errorf("overall progress ends at %v, want %d of %d", last, total, total)
+	}
+}
@@ -0,0 +1,128 @@
+package patch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// errPartlyExtracted is a streamed download cancelled after some of its
+// entries were written
+var errPartlyExtracted = errors.New("cancelled part way through a streamed extraction")
+
+// streamable reports whether file can be extracted straight from the
+// download. A published checksum can only be checked once the whole archive
+// is there, before anything is extracted, so those files keep the
+// write-then-extract path, as do deltas and anything that is not a tar.gz.
+func (p *Patcher) streamable(file string) bool {
+	if !p.config.Stream {
+		return false
+	}
+	if _, ok := p.checksums[file]; ok {
+		return false
+	}
+	if _, ok := p.deltas[file]; ok {
+		return false
+	}
+	return strings.HasSuffix(file, ".tar.gz") || strings.HasSuffix(file, ".tgz")
+}
+
+// downloadStreamed extracts the archive in body into the install directory as
+// it arrives, saving replaced files to bak. Nothing is written for the
+// archive itself, so a stopped download starts over on the next attempt and
+// rewrites the entries it had already extracted.
+func (p *Patcher) downloadStreamed(ctx context.Context, stall *time.Timer, body io.Reader, source string, file string, order int, total int64) error {
+	download := p.downloads[order-1]
+	download.total.Store(total)
+	download.current.Store(0)
+	p.refresh(download)
+	p.progress.FileStatus(order, i18n.Tr("status.streaming"))
+
+	tracked := &trackedReader{r: p.limiter.reader(ctx, body), p: p, download: download, stall: stall, total: total}
+	start := time.Now()
+	rec := newEntryRecorder(p.directory)
+	written, err := untarStream(tracked, filepath.Base(file), p.directory, p.bak, rec)
+	if err == nil {
+		// Count any padding after the gzip stream towards the download
+		_, err = io.Copy(io.Discard, tracked)
+	}
+	p.refresh(download)
+	if err != nil {
+		p.index.forget(download.file)
+		err = downloadError(ctx, err)
+		// Entries already extracted stay in place, so a cancel part way fails
+		// the patch instead of skipping the file, and a backup is rolled back
+		if errors.Is(err, errCancelled) && written > 0 {
+			err = fmt.Errorf("%w after extracting %d entries", errPartlyExtracted, written)
+		}
+		if !stopped(err) {
+			slog.Error("Streamed extraction failed", "file", file, "source", source, "bytes", download.current.Load(), "err", err)
+			reason := i18n.Tr("failed.download")
+			var extractErr *extractError
+			if errors.As(err, &extractErr) {
+				reason = i18n.Tr("failed.extraction")
+			} else if errors.Is(err, errPartlyExtracted) {
+				reason = i18n.Tr("failed.partlyExtracted")
+			}
+			p.progress.FileFailed(order, reason, err)
+		}
+		return err
+	}
+
+	download.streamed = true
+	p.index.set(download.file, rec.entries)
+	slog.Info("Downloaded and extracted", "file", file, "source", source, "bytes", download.current.Load(), "duration", time.Since(start))
+	return nil
+}
+
+// trackedReader counts the bytes of a streamed download, keeping the stall
+// timer, the bars and the speed up to date as the extractor reads
+type trackedReader struct {
+	r        io.Reader
+	p        *Patcher
+	download *download
+	stall    *time.Timer
+	total    int64
+
+	lastTime   time.Time
+	lastUpdate time.Time
+	lastBytes  int64
+	smoothed   float64
+}
+
+func (t *trackedReader) Read(buf []byte) (int, error) {
+	n, err := t.r.Read(buf)
+	if n == 0 {
+		return n, err
+	}
+
+	t.stall.Reset(stallTimeout)
+	current := t.download.current.Add(int64(n))
+	now := time.Now()
+	if t.lastTime.IsZero() {
+		t.lastTime, t.lastUpdate = now, now
+	}
+	if elapsed := now.Sub(t.lastTime).Seconds(); elapsed >= 1 {
+		t.smoothed = smoothSpeed(t.smoothed, float64(current-t.lastBytes)/elapsed)
+		remaining := int64(-1)
+		if t.total > 0 {
+			remaining = t.total - current
+		}
+		t.p.progress.FileSpeed(t.download.order, t.smoothed, remaining)
+		t.p.setSpeed(t.download, t.smoothed)
+		t.lastBytes = current
+		t.lastTime = now
+	}
+	if now.Sub(t.lastUpdate) >= uiUpdateInterval {
+		t.p.refresh(t.download)
+		t.lastUpdate = now
+	}
+	return n, err
+}
@@ -0,0 +1,205 @@
+package patch
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// serveUntil sends the first sent bytes of data as name, then holds the
+// response open until the client goes away. HEAD requests get the size. The
+// returned channel is closed once the body starts.
+func serveUntil(t *testing.T, name string, data []byte, sent int) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	started := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path[1:] != name {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(data[:sent])
+		w.(http.Flusher).Flush()
+		once.Do(func() { close(started) })
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+	return server, started
+}
+
+// startPatcher runs a patch in the background, returning the Patcher, what
+// it reports and a channel that receives its result. The patch is stopped
+// when the test ends.
+func startPatcher(t *testing.T, config Config, files ...string) (*Patcher, *testProgress, <-chan *Result) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	progress := newTestProgress()
+	p := New(ctx, http.DefaultClient, config, Manifest{Files: files}, progress)
+	done := make(chan *Result, 1)
+	go func() { done <- p.Run() }()
+	return p, progress, done
+}
+
+// waitFor polls until ready reports true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, ready func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !ready(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitResult returns the result of a patch started with startPatcher
+func waitResult(t *testing.T, done <-chan *Result) *Result {
+	t.Helper()
+	select {
+	case result := <-done:
+		if result == nil {
+			t.Fatal("patch did not start")
+		}
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("patch did not finish")
+		return nil
+	}
+}
+
+func TestRunStreamsArchives(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{
+		"p.tar.gz": tarGz(t, tarEntry{name: "data/a.txt", body: "a"}, tarEntry{name: "data/sub/b.txt", body: "b"}),
+	})
+	config := testConfig(t, server.URL)
+	config.Stream = true
+
+	result, progress := runPatcher(t, config, "p.tar.gz")
+	if !result.Success {
+		t.Fatalf("patch failed: %+v", result.Files)
+	}
+	if !slices.Contains(progress.statuses[1], i18n.Tr("status.streaming")) {
+		t.Errorf("p.tar.gz statuses %q, want it streamed", progress.statuses[1])
+	}
+	for name, want := range map[string]string{"data/a.txt": "a", "data/sub/b.txt": "b"} {
+		if got := readFile(t, config.Directory, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"p.tar.gz", "p.tar.gz" + partSuffix} {
+		if exists(config.Directory, name) {
+			t.Errorf("streamed download left %s behind", name)
+		}
+	}
+
+	entries, ok := loadIndex(config.Directory).entries("p.tar.gz")
+	if !ok || len(entries) != 2 || entries[0].Path != "data/a.txt" || entries[1].Path != "data/sub/b.txt" {
+		t.Errorf("p.tar.gz indexed as %+v", entries)
+	}
+}
+
+func TestRunFailedStreamRestoresBackup(t *testing.T) {
+	// Random data does not compress, so the first entry is extracted well
+	// before the body goes wrong
+	noise := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(noise)
+	archive := tarGz(t, tarEntry{name: "a.txt", body: "new"}, tarEntry{name: "b.bin", body: string(noise)})
+	corrupt := append([]byte{}, archive...)
+	for i := len(corrupt) / 2; i < len(corrupt)/2+1024; i++ {
+		corrupt[i] ^= 0xff
+	}
+	bodies := map[string][]byte{"short": archive[:len(archive)/2], "corrupt": corrupt}
+
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			fastRetries(t)
+			server := serveFiles(t, map[string][]byte{"p.tar.gz": body})
+			config := testConfig(t, server.URL)
+			config.Stream = true
+			config.Backup = true
+			if err := os.WriteFile(filepath.Join(config.Directory, "a.txt"), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			result, progress := runPatcher(t, config, "p.tar.gz")
+			if result.Success || result.Files[0].Error == "" {
+				t.Fatalf("patch succeeded with a %s body: %+v", name, result.Files)
+			}
+			if progress.failed[1] == nil {
+				t.Error("bar not marked failed")
+			}
+			if got := readFile(t, config.Directory, "a.txt"); got != "old" {
+				t.Errorf("a.txt = %q after the failed patch, want the backup %q restored", got, "old")
+			}
+			for _, leftover := range []string{"b.bin", "p.tar.gz", "p.tar.gz" + partSuffix} {
+				if exists(config.Directory, leftover) {
+					t.Errorf("failed stream left %s behind", leftover)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelPartlyStreamedFails(t *testing.T) {
+	// Random data does not compress, so the first entry is decoded well
+	// before the stream is cut off
+	noise := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(noise)
+	archive := tarGz(t, tarEntry{name: "a.txt", body: "new"}, tarEntry{name: "b.bin", body: string(noise)})
+	server, _ := serveUntil(t, "p.tar.gz", archive, len(archive)/2)
+
+	config := testConfig(t, server.URL)
+	config.Stream = true
+	config.Backup = true
+	if err := os.WriteFile(filepath.Join(config.Directory, "a.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, _, done := startPatcher(t, config, "p.tar.gz")
+	waitFor(t, "a.txt to be extracted", func() bool {
+		data, _ := os.ReadFile(filepath.Join(config.Directory, "a.txt"))
+		return string(data) == "new"
+	})
+	p.Cancel(1)
+
+	result := waitResult(t, done)
+	if result.Success || result.Files[0].Skipped || result.Files[0].Error == "" {
+		t.Fatalf("result = %+v, want the file failed rather than skipped", result)
+	}
+	if got := readFile(t, config.Directory, "a.txt"); got != "old" {
+		t.Errorf("a.txt = %q after the failed patch, want the backup %q restored", got, "old")
+	}
+}
+
+func TestCancelStreamBeforeExtractingSkips(t *testing.T) {
+	archive := tarGz(t, tarEntry{name: "a.txt", body: "new"})
+	server, started := serveUntil(t, "p.tar.gz", archive, 0)
+	config := testConfig(t, server.URL)
+	config.Stream = true
+
+	p, _, done := startPatcher(t, config, "p.tar.gz")
+	<-started
+	p.Cancel(1)
+
+	result := waitResult(t, done)
+	if !result.Files[0].Skipped {
+		t.Fatalf("result = %+v, want the file skipped", result.Files[0])
+	}
+	if exists(config.Directory, "a.txt") {
+		t.Error("a.txt extracted from a cancelled download")
+	}
+}
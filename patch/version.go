@@ -0,0 +1,31 @@
+package patch
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Written to the install directory after a fully successful patch, holding
+// the manifest version that was applied
+var versionFile = "patch-version.txt"
+
+// localVersion returns the patch version recorded in directory, or "" if none
+// has been applied yet, which always means the patch is needed
+func localVersion(directory string) string {
+	data, err := os.ReadFile(directory + "/" + versionFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Unable to read patch version", "directory", directory, "err", err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeVersion records the applied patch version. It is only called once every
+// file has been extracted, so an interrupted run leaves the previous version
+// and the next run patches again.
+func writeVersion(directory string, version string) error {
+	return os.WriteFile(directory+"/"+versionFile, []byte(version+"\n"), 0644)
+}
@@ -0,0 +1,67 @@
+package patch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunVersions(t *testing.T) {
+	server := serveFiles(t, map[string][]byte{"a.bin": []byte("v2")})
+
+	for _, test := range []struct {
+		name      string
+		installed string // contents of the version file, none if empty
+		upToDate  bool
+	}{
+		{name: "missing", upToDate: false},
+		{name: "stale", installed: "v1\n", upToDate: false},
+		{name: "current", installed: "v2\n", upToDate: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig(t, server.URL)
+			if test.installed != "" {
+				if err := os.WriteFile(filepath.Join(config.Directory, versionFile), []byte(test.installed), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			manifest := Manifest{Version: "v2", Files: []string{"a.bin"}}
+			result := New(context.Background(), http.DefaultClient, config, manifest, newTestProgress()).Run()
+
+			if !result.Success || result.UpToDate != test.upToDate || result.Version != "v2" {
+				t.Fatalf("result = %+v, want success, up to date %v and version v2", result, test.upToDate)
+			}
+			if downloaded := exists(config.Directory, "a.bin"); downloaded == test.upToDate {
+				t.Errorf("a.bin downloaded = %v", downloaded)
+			}
+			if got := localVersion(config.Directory); got != "v2" {
+				t.Errorf("installed version = %q, want v2", got)
+			}
+			var written Result
+			if err := json.Unmarshal([]byte(readFile(t, config.Directory, resultFile)), &written); err != nil {
+				t.Fatal(err)
+			}
+			if written.Version != "v2" {
+				t.Errorf("%s version = %q, want v2", resultFile, written.Version)
+			}
+		})
+	}
+}
+
+func TestFailedRunKeepsVersion(t *testing.T) {
+	config := testConfig(t, serveFiles(t, nil).URL)
+	if err := os.WriteFile(filepath.Join(config.Directory, versionFile), []byte("v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := Manifest{Version: "v2", Files: []string{"missing.bin"}}
+	if result := New(context.Background(), http.DefaultClient, config, manifest, newTestProgress()).Run(); result.Success {
+		t.Fatal("patch succeeded without its file")
+	}
+	if got := localVersion(config.Directory); got != "v1" {
+		t.Errorf("installed version = %q after a failed patch, want v1 kept", got)
+	}
+}
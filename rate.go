@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rateText formats a rate in the form parseRate reads, using the largest unit
+// that divides it exactly, or "" for no cap
+func rateText(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return ""
+	}
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+	} {
+		if bytesPerSecond%unit.size == 0 {
+			return strconv.FormatInt(bytesPerSecond/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(bytesPerSecond, 10) + "B"
+}
+
+// parseRate reads a transfer rate such as "2MB", "512KB" or "1.5GB/s" and
+// returns it in bytes per second. Units are binary, as elsewhere in the UI.
+func parseRate(s string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	text = strings.TrimSuffix(text, "/S")
+
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"G", 1024 * 1024 * 1024},
+		{"M", 1024 * 1024},
+		{"K", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q: expected a size such as 512KB or 2MB", s)
+	}
+	return int64(value * multiplier), nil
+}
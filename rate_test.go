@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"512B":    512,
+		"512KB":   512 * 1024,
+		"512k":    512 * 1024,
+		"2MB":     2 * 1024 * 1024,
+		"2 MB/s":  2 * 1024 * 1024,
+		"1.5GB":   1536 * 1024 * 1024,
+		" 3m/s  ": 3 * 1024 * 1024,
+	}
+	for text, want := range tests {
+		if got, err := parseRate(text); err != nil || got != want {
+			t.Errorf("parseRate(%q) = %d, %v, want %d", text, got, err, want)
+		}
+	}
+	for _, text := range []string{"", "fast", "-1MB", "2TB", "MB"} {
+		if got, err := parseRate(text); err == nil {
+			t.Errorf("parseRate(%q) = %d, want an error", text, got)
+		}
+	}
+}
+
+func TestRateTextRoundTrips(t *testing.T) {
+	for _, rate := range []int64{1, 1000, 1024, 1536, 2 * 1024 * 1024, 3 * 1024 * 1024 * 1024} {
+		text := rateText(rate)
+		if got, err := parseRate(text); err != nil || got != rate {
+			t.Errorf("rateText(%d) = %q, which parses as %d, %v", rate, text, got, err)
+		}
+	}
+	if text := rateText(0); text != "" {
+		t.Errorf("rateText(0) = %q, want no cap", text)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !nogui
+
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/therecipe/qt/widgets"
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// showSettings opens the settings dialog filled with the current values. On
+// OK the changes are checked, saved to the config file and applied to the
+// downloads that have not finished yet; invalid values keep the dialog open.
+func (p *ProgressBarWindow) showSettings() {
+	dialog := widgets.NewQDialog(p.window, 0)
+	dialog.SetWindowTitle(i18n.Tr("settings.title"))
+
+	list := settings.Sources()
+	source := widgets.NewQLineEdit2(list[0], nil)
+	mirrorList := widgets.NewQLineEdit2(strings.Join(list[1:], ", "), nil)
+	mirrorList.SetPlaceholderText(i18n.Tr("settings.noMirrors"))
+	downloads := widgets.NewQSpinBox(nil)
+	downloads.SetRange(1, 16)
+	downloads.SetValue(settings.MaxDownloads)
+	rate := widgets.NewQLineEdit2(rateText(settings.MaxRate), nil)
+	rate.SetPlaceholderText(i18n.Tr("settings.unlimited"))
+
+	form := widgets.NewQFormLayout(nil)
+	form.AddRow3(i18n.Tr("settings.source"), source)
+	form.AddRow3(i18n.Tr("settings.mirrors"), mirrorList)
+	form.AddRow3(i18n.Tr("settings.downloads"), downloads)
+	form.AddRow3(i18n.Tr("settings.maxRate"), rate)
+
+	buttons := widgets.NewQDialogButtonBox3(widgets.QDialogButtonBox__Ok|widgets.QDialogButtonBox__Cancel, nil)
+	buttons.ConnectAccepted(func() {
+		config, err := loadConfig().withSettings(source.Text(), mirrorList.Text(), downloads.Value(), rate.Text())
+		if err != nil {
+			widgets.QMessageBox_Warning(dialog, appName, i18n.Tr("dialog.invalidSettings", err.Error()), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+			return
+		}
+		if err := config.save(); err != nil {
+			slog.Error("Unable to save config", "err", err)
+		}
+		applySettings(config)
+		p.patcher.SetSources(settings.Source, settings.Mirrors)
+		p.patcher.SetMaxDownloads(settings.MaxDownloads)
+		p.patcher.SetMaxRate(settings.MaxRate)
+		slog.Info("Settings changed", "source", config.Source, "mirrors", config.Mirrors, "downloads", config.Downloads, "maxRate", config.MaxRate)
+		dialog.Accept()
+	})
+	buttons.ConnectRejected(dialog.Reject)
+
+	layout := widgets.NewQVBoxLayout()
+	layout.AddLayout(form, 0)
+	layout.AddWidget(buttons, 0, 0)
+	dialog.SetLayout(layout)
+	dialog.Exec()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// How often the overall progress line is printed in headless mode
+var textUpdateInterval = 2 * time.Second
+
+// TextProgress prints a patch run to stdout for terminals and scripts
+type TextProgress struct {
+	mu         sync.Mutex
+	files      []string
+	speed      float64
+	lastUpdate time.Time
+}
+
+func NewTextProgress(files []string) *TextProgress {
+	return &TextProgress{files: files}
+}
+
+// runHeadless patches the install directory without a window and returns the
+// exit code, 0 only if every file was applied
+func runHeadless(ctx context.Context, cancel context.CancelFunc, client *http.Client, options Options) int {
+	var interrupted atomic.Bool
+	catchInterrupt(ctx, func() {
+		interrupted.Store(true)
+		cancel()
+	})
+
+	// The directory used last time is the default, -dir replaces it
+	config := loadConfig()
+	if options.Directory == "" {
+		options.Directory = config.Directory
+	}
+	if options.Directory == "" {
+		options.Directory = "."
+	}
+	if !options.DryRun {
+		rememberDirectory(config, options.Directory)
+	}
+
+	manifest, err := patch.FetchManifest(ctx, client, settings.Sources())
+	if ctx.Err() != nil {
+		return exitCode(nil, interrupted.Load())
+	}
+	if err != nil {
+		slog.Error("Unable to fetch manifest", "err", err)
+		return 1
+	}
+	files = manifest.Files
+
+	if launcherTooOld(manifest) {
+		slog.Error("Patcher too old for this patch", "required", manifest.MinPatcherVersion, "running", launcherVersion)
+		fmt.Println(i18n.Tr("dialog.tooOld", manifest.MinPatcherVersion, launcherVersion))
+		if updateSatisfies(manifest) {
+			fmt.Println(i18n.Tr("text.updateAvailable", manifest.LauncherVersion, launcherVersion))
+		}
+		return 1
+	}
+
+	// Replacing the binary needs the player's consent, which only the window asks for
+	if launcherOutdated(manifest) {
+		slog.Info("Patcher update available", "version", manifest.LauncherVersion, "running", launcherVersion)
+		fmt.Println(i18n.Tr("text.updateAvailable", manifest.LauncherVersion, launcherVersion))
+	}
+
+	if options.DryRun {
+		fmt.Println(planText(patch.New(ctx, client, patchConfig(options.Directory), manifest, nil).Plan()))
+		return 0
+	}
+
+	result := patch.New(ctx, client, patchConfig(options.Directory), manifest, NewTextProgress(files)).Run()
+	if code := exitCode(result, interrupted.Load()); code != 0 {
+		return code
+	}
+	if _, err := launchIfPatched(result); err != nil {
+		slog.Error("Unable to launch game", "path", launchPath, "err", err)
+		return 1
+	}
+	return 0
+}
+
+// hasDisplay reports whether a window can be shown. Windows and macOS always
+// have a desktop; elsewhere an X11 or Wayland session is needed.
+func hasDisplay() bool {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		return true
+	}
+	return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+}
+
+func (t *TextProgress) FileStatus(order int, status string) {
+	if status == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Printf("%s: %s\n", t.files[order-1], status)
+}
+
+// FileProgress is left to the overall line, printing every file would flood the terminal
+func (t *TextProgress) FileProgress(order int, current int64, total int64) {}
+
+// FileSpeed is left to the overall line as well, which shows the combined
+// speed and the time left for the whole patch
+func (t *TextProgress) FileSpeed(order int, speed float64, remaining int64) {}
+
+func (t *TextProgress) FileFailed(order int, reason string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Printf("%s: %s: %v\n", t.files[order-1], reason, err)
+}
+
+func (t *TextProgress) OverallSpeed(speed float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.speed = speed
+}
+
+func (t *TextProgress) DownloadFinished(order int) {}
+
+func (t *TextProgress) Overall(current int64, total int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastUpdate) < textUpdateInterval && current != total {
+		return
+	}
+	t.lastUpdate = now
+
+	text := i18n.Tr("text.downloaded", sizeText(current, total))
+	if p := percent(current, total); p >= 0 {
+		text += fmt.Sprintf(" (%d%%)", p)
+	}
+	if t.speed > 0 {
+		remaining := int64(-1)
+		if total > 0 {
+			remaining = total - current
+		}
+		text += " " + i18n.Tr("text.at", speedText(t.speed, remaining))
+	}
+	fmt.Println(text)
+}
+
+func (t *TextProgress) Error(message string) {
+	fmt.Println(message)
+}
+
+func (t *TextProgress) Finished(result *patch.Result) {
+	failed := result.Failures()
+	if result.UpToDate {
+		fmt.Println(i18n.Tr("text.upToDate"))
+		return
+	}
+	if len(failed) == 0 {
+		fmt.Println(i18n.Tr("text.success"))
+		if result.Repair {
+			fmt.Println(repairSummary(result))
+		}
+		if unverified := result.Unverified(); len(unverified) > 0 {
+			fmt.Println(i18n.Tr("dialog.unverified", len(unverified)))
+		}
+		return
+	}
+
+	fmt.Println(i18n.Tr("dialog.failures"))
+	for _, file := range failed {
+		fmt.Println("  " + file.File + ": " + file.Error)
+	}
+}
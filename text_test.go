@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// isolateConfig keeps the saved settings and the log file of the test run
+// away from the user's own
+func isolateConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+	t.Setenv("LocalAppData", dir)
+}
+
+// serveSource serves files as the patch source for the rest of the test
+func serveSource(t *testing.T, files map[string]string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader([]byte(data)))
+	}))
+	t.Cleanup(server.Close)
+
+	saved := settings
+	settings.Source = server.URL + "/"
+	settings.Mirrors = nil
+	t.Cleanup(func() { settings = saved })
+}
+
+// headless runs runHeadless over a fresh install directory and returns its
+// exit code and the directory
+func headless(t *testing.T, options Options) (int, string) {
+	t.Helper()
+	if options.Directory == "" {
+		options.Directory = t.TempDir()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return runHeadless(ctx, cancel, http.DefaultClient, options), options.Directory
+}
+
+func TestRunHeadless(t *testing.T) {
+	isolateConfig(t)
+
+	t.Run("patched", func(t *testing.T) {
+		serveSource(t, map[string]string{"info.txt": "a.bin\n", "a.bin": "contents"})
+		code, dir := headless(t, Options{NoGUI: true})
+		if code != 0 {
+			t.Fatalf("exit code %d, want 0", code)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "a.bin")); err != nil || string(data) != "contents" {
+			t.Errorf("a.bin = %q, %v", data, err)
+		}
+	})
+
+	t.Run("file missing", func(t *testing.T) {
+		serveSource(t, map[string]string{"info.txt": "a.bin\nmissing.bin\n", "a.bin": "contents"})
+		if code, _ := headless(t, Options{NoGUI: true}); code != 1 {
+			t.Errorf("exit code %d, want 1", code)
+		}
+	})
+
+	t.Run("no manifest", func(t *testing.T) {
+		serveSource(t, nil)
+		if code, _ := headless(t, Options{NoGUI: true}); code != 1 {
+			t.Errorf("exit code %d, want 1", code)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		serveSource(t, map[string]string{"info.txt": "a.bin\n", "a.bin": "contents"})
+		code, dir := headless(t, Options{NoGUI: true, DryRun: true})
+		if code != 0 {
+			t.Fatalf("exit code %d, want 0", code)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("dry run wrote %d files", len(entries))
+		}
+	})
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      *patch.Result
+		interrupted bool
+		want        int
+	}{
+		{"patched", &patch.Result{Success: true}, false, 0},
+		{"failed", &patch.Result{}, false, 1},
+		{"not started", nil, false, 1},
+		{"interrupted", &patch.Result{}, true, exitInterrupted},
+		{"interrupted before starting", nil, true, exitInterrupted},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.result, test.interrupted); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRunHeadlessInterrupted(t *testing.T) {
+	isolateConfig(t)
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/info.txt":
+			w.Write([]byte("a.bin\n"))
+		case r.URL.Path == "/a.bin" && r.Method == http.MethodGet:
+			w.Write([]byte("the first bytes"))
+			w.(http.Flusher).Flush()
+			once.Do(func() { close(started) })
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	saved := settings
+	settings.Source = server.URL + "/"
+	settings.Mirrors = nil
+	t.Cleanup(func() { settings = saved })
+
+	codes := make(chan int, 1)
+	go func() {
+		code, _ := headless(t, Options{NoGUI: true})
+		codes <- code
+	}()
+	<-started
+	// Caught by the handler runHeadless installs, as Ctrl+C would be
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot interrupt the test process: %v", err)
+	}
+	select {
+	case code := <-codes:
+		if code != exitInterrupted {
+			t.Errorf("exit code %d, want %d", code, exitInterrupted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("interrupted run did not stop")
+	}
+}
+
+// captureOutput returns what f prints to stdout
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		output <- buf.String()
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestTextProgressShowsTimeLeft(t *testing.T) {
+	progress := NewTextProgress([]string{"a.bin"})
+	got := captureOutput(t, func() {
+		progress.OverallSpeed(1024)
+		progress.Overall(1024, 4096)
+	})
+	want := "Downloaded 1.0 / 4.0 KB (25%) at 1.00 KB/s — 00:03 left\n"
+	if got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	// Without a total there is nothing to count down
+	progress = NewTextProgress([]string{"a.bin"})
+	got = captureOutput(t, func() {
+		progress.OverallSpeed(1024)
+		progress.Overall(1024, -1)
+	})
+	if strings.Contains(got, "left") || !strings.Contains(got, "1.00 KB/s") {
+		t.Errorf("printed %q with an unknown total", got)
+	}
+}
@@ -0,0 +1,124 @@
+//go:build !nogui
+
+package main
+
+import (
+	"sync"
+
+	"github.com/therecipe/qt/core"
+)
+
+// How often the window is repainted and queued UI work is run on the main
+// thread, in milliseconds; about 30 times a second
+var uiTimerInterval = 33
+
+// startUI starts the single timer that updates the window on the Qt main
+// thread. Each tick paints the latest progress of every bar that changed, then
+// drains the work queued by onMain. It must be called from the main thread
+// before the event loop starts.
+func (p *ProgressBarWindow) startUI() {
+	p.ui = make(chan func(), 64)
+
+	timer := core.NewQTimer(p.window)
+	timer.ConnectTimeout(func() {
+		p.paint()
+		for {
+			select {
+			case f := <-p.ui:
+				f()
+			default:
+				return
+			}
+		}
+	})
+	timer.Start(uiTimerInterval)
+}
+
+// paint updates the widgets whose snapshot changed since the last tick
+func (p *ProgressBarWindow) paint() {
+	for _, bar := range p.bars {
+		if progress, ok := bar.progress.take(); ok {
+			updateProgressBar(bar.progressBar, progress.current, progress.total)
+		}
+		if speed, ok := bar.speed.take(); ok {
+			bar.label.SetText(speedText(speed.speed, speed.remaining))
+		}
+	}
+
+	if progress, ok := p.overallProgress.take(); ok {
+		if progress.total <= 0 {
+			p.overall.SetRange(0, 0)
+		} else {
+			p.overall.SetRange(0, 100)
+			updateProgressBar(p.overall, progress.current, progress.total)
+		}
+	}
+	if speed, ok := p.overallRate.take(); ok {
+		if speed.speed <= 0 {
+			p.overallSpeed.SetText("")
+		} else {
+			p.overallSpeed.SetText(speedText(speed.speed, -1))
+		}
+	}
+}
+
+// onMain queues f to run on the Qt main thread. Widgets must not be touched
+// from other goroutines, so background work hands its updates over this way.
+// Frequent progress updates go through a snapshot instead.
+func (p *ProgressBarWindow) onMain(f func()) {
+	select {
+	case p.ui <- f:
+	case <-p.ctx.Done():
+	}
+}
+
+// onMainWait runs f on the Qt main thread and waits until it has, returning
+// false if the window was closed first
+func (p *ProgressBarWindow) onMainWait(f func()) bool {
+	ran := make(chan struct{})
+	p.onMain(func() {
+		f()
+		close(ran)
+	})
+	select {
+	case <-ran:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// snapshot holds the latest of a frequently reported value until the next
+// paint. However often the downloads report, the widget is updated at most
+// once per tick, and not at all if nothing changed.
+type snapshot[T any] struct {
+	mu    sync.Mutex
+	value T
+	dirty bool
+}
+
+func (s *snapshot[T]) set(value T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value = value
+	s.dirty = true
+}
+
+// take returns the value if it changed since the last take
+func (s *snapshot[T]) take() (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirty := s.dirty
+	s.dirty = false
+	return s.value, dirty
+}
+
+type progressValue struct {
+	current int64
+	total   int64
+}
+
+type speedValue struct {
+	speed     float64
+	remaining int64
+}
@@ -0,0 +1,93 @@
+//go:build !nogui
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotKeepsLatest(t *testing.T) {
+	var s snapshot[progressValue]
+	if _, ok := s.take(); ok {
+		t.Error("take of an unset snapshot reported a change")
+	}
+	for i := int64(1); i <= 3; i++ {
+		s.set(progressValue{current: i, total: 3})
+	}
+	if value, ok := s.take(); !ok || value != (progressValue{current: 3, total: 3}) {
+		t.Errorf("take = %+v, %v, want the last value set", value, ok)
+	}
+	if _, ok := s.take(); ok {
+		t.Error("second take reported a change with nothing set")
+	}
+}
+
+func TestSnapshotCoalescesUpdates(t *testing.T) {
+	// Many files reporting every read, as a large manifest does
+	const files, reports = 200, 500
+	bars := make([]snapshot[progressValue], files)
+	report := func() {
+		var wg sync.WaitGroup
+		for i := range bars {
+			wg.Add(1)
+			go func(bar *snapshot[progressValue]) {
+				defer wg.Done()
+				for n := int64(1); n <= reports; n++ {
+					bar.set(progressValue{current: n, total: reports})
+				}
+			}(&bars[i])
+		}
+		wg.Wait()
+	}
+	var painted atomic.Int64
+	paint := func() {
+		for i := range bars {
+			if value, ok := bars[i].take(); ok {
+				painted.Add(1)
+				if value.current < 1 || value.current > reports {
+					t.Errorf("bar %d painted at %d", i, value.current)
+				}
+			}
+		}
+	}
+
+	// Everything reported between two ticks is one update per bar
+	report()
+	paint()
+	if got := painted.Load(); got != files {
+		t.Errorf("%d widget updates for %d reports in one tick, want %d", got, files*reports, files)
+	}
+
+	// With the timer running alongside, each tick updates a bar at most once
+	painted.Store(0)
+	stop := make(chan struct{})
+	ticks := make(chan int64)
+	go func() {
+		var n int64
+		for {
+			select {
+			case <-stop:
+				ticks <- n
+				return
+			case <-time.After(time.Millisecond):
+				paint()
+				n++
+			}
+		}
+	}()
+	report()
+	close(stop)
+	n := <-ticks + 1
+	paint()
+	if got := painted.Load(); got > n*files {
+		t.Errorf("%d widget updates in %d ticks of %d bars", got, n, files)
+	}
+	for i := range bars {
+		if bars[i].value.current != reports {
+			t.Fatalf("bar %d left at %d of %d", i, bars[i].value.current, reports)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// Version of this binary, set at build time with
+// -ldflags "-X main.launcherVersion=1.2.0". Development builds never update.
+var launcherVersion = "dev"
+
+// launcherBinary is the name the release for this platform is published
+// under on the patch source, e.g. araxiapatch-windows-amd64.exe
+func launcherBinary() string {
+	name := "araxiapatch-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// launcherOutdated reports whether the manifest names a newer launcher than
+// the one running
+func launcherOutdated(manifest patch.Manifest) bool {
+	return launcherVersion != "dev" && manifest.LauncherVersion != "" &&
+		compareVersions(manifest.LauncherVersion, launcherVersion) > 0
+}
+
+// launcherTooOld reports whether the manifest needs a newer patcher than the
+// one running to apply the patch. Development builds are never refused.
+func launcherTooOld(manifest patch.Manifest) bool {
+	return launcherVersion != "dev" && manifest.MinPatcherVersion != "" &&
+		compareVersions(launcherVersion, manifest.MinPatcherVersion) < 0
+}
+
+// updateSatisfies reports whether the release the manifest offers is new
+// enough to apply the patch
+func updateSatisfies(manifest patch.Manifest) bool {
+	return manifest.LauncherVersion != "" &&
+		compareVersions(manifest.LauncherVersion, manifest.MinPatcherVersion) >= 0
+}
+
+// compareVersions orders dotted versions such as "1.10.2" and "v1.9",
+// returning -1, 0 or 1. Numeric parts compare as numbers, others as text, and
+// missing parts count as 0.
+func compareVersions(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xErr != nil || yErr != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// updateLauncher downloads the launcher named by the manifest next to the
+// running binary, checks it against the published checksum and swaps it in.
+// The running process keeps its copy, so the new version starts next time.
+func updateLauncher(ctx context.Context, client *http.Client, manifest patch.Manifest) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	checksums, err := patch.FetchChecksums(ctx, client, settings.Sources())
+	if err != nil {
+		return fmt.Errorf("unable to fetch checksums: %w", err)
+	}
+	name := launcherBinary()
+	expected, ok := checksums[name]
+	if !ok {
+		return fmt.Errorf("no checksum published for %s", name)
+	}
+
+	staged := exe + ".new"
+	if err := downloadLauncher(ctx, client, name, staged, expected); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	if err := swapBinary(exe, staged); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	slog.Info("Patcher updated", "from", launcherVersion, "to", manifest.LauncherVersion, "path", exe)
+	return nil
+}
+
+// downloadLauncher writes the release to path, failing unless its SHA-256 is
+// expected
+func downloadLauncher(ctx context.Context, client *http.Client, name string, path string, expected string) error {
+	resp, err := patch.Fetch(ctx, client, settings.Sources(), name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), resp.Body); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, expected, sum)
+	}
+	return nil
+}
+
+// swapBinary replaces exe with staged. Windows will not overwrite or delete a
+// running executable but does let it be renamed, so exe is first moved aside
+// to exe.old; if the second rename fails it is moved back. The old copy is
+// removed straight away where the system allows it, otherwise by
+// removeOldBinary on the next start.
+func swapBinary(exe string, staged string) error {
+	old := exe + ".old"
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		if restoreErr := os.Rename(old, exe); restoreErr != nil {
+			slog.Error("Unable to restore patcher", "path", exe, "err", restoreErr)
+		}
+		return err
+	}
+	os.Remove(old)
+	return nil
+}
+
+// removeOldBinary deletes the copy a previous update left behind on Windows
+func removeOldBinary() {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return
+	}
+	if err := os.Remove(exe + ".old"); err == nil {
+		slog.Debug("Removed previous patcher", "path", exe+".old")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// runningVersion pretends the binary was built as version for the rest of the test
+func runningVersion(t *testing.T, version string) {
+	t.Helper()
+	saved := launcherVersion
+	launcherVersion = version
+	t.Cleanup(func() { launcherVersion = saved })
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.2.0", "1.2.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.9", "1.10", -1},
+		{"2", "1.99.99", 1},
+		{"1.2.0-beta", "1.2.0-rc", -1},
+	} {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestLauncherTooOld(t *testing.T) {
+	manifest := patch.Manifest{MinPatcherVersion: "1.10.0"}
+	for version, want := range map[string]bool{"1.9.3": true, "1.10.0": false, "1.10.1": false, "2.0": false, "dev": false} {
+		runningVersion(t, version)
+		if got := launcherTooOld(manifest); got != want {
+			t.Errorf("launcherTooOld with %s running = %v, want %v", version, got, want)
+		}
+	}
+
+	runningVersion(t, "1.0.0")
+	if launcherTooOld(patch.Manifest{}) {
+		t.Error("refused a manifest without a minimum version")
+	}
+}
+
+func TestUpdateSatisfies(t *testing.T) {
+	for _, test := range []struct {
+		latest string
+		want   bool
+	}{
+		{"", false},
+		{"1.9.0", false},
+		{"1.10.0", true},
+		{"1.11.0", true},
+	} {
+		manifest := patch.Manifest{MinPatcherVersion: "1.10.0", LauncherVersion: test.latest}
+		if got := updateSatisfies(manifest); got != test.want {
+			t.Errorf("updateSatisfies with %q offered = %v, want %v", test.latest, got, test.want)
+		}
+	}
+}
+
+func TestDownloadLauncher(t *testing.T) {
+	release := "new patcher build"
+	serveSource(t, map[string]string{"araxiapatch-test": release})
+	sum := sha256.Sum256([]byte(release))
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "araxiapatch.new")
+	if err := downloadLauncher(context.Background(), http.DefaultClient, "araxiapatch-test", path, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if data, _ := os.ReadFile(path); err != nil || string(data) != release {
+		t.Fatalf("staged %q, %v", data, err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0100 == 0 {
+		t.Errorf("staged binary has mode %v, want it executable", info.Mode().Perm())
+	}
+
+	err = downloadLauncher(context.Background(), http.DefaultClient, "araxiapatch-test", filepath.Join(dir, "bad.new"), strings.Repeat("0", 64))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("tampered release gave %v, want a checksum mismatch", err)
+	}
+}
+
+func TestSwapBinary(t *testing.T) {
+	// writeBinaries lays out a running binary and what is staged next to it
+	writeBinaries := func(t *testing.T, files map[string]string) string {
+		dir := t.TempDir()
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return filepath.Join(dir, "araxiapatch")
+	}
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "missing"
+		}
+		return string(data)
+	}
+
+	t.Run("swapped", func(t *testing.T) {
+		// A copy left by an earlier update is replaced
+		exe := writeBinaries(t, map[string]string{"araxiapatch": "v1", "araxiapatch.new": "v2", "araxiapatch.old": "v0"})
+		if err := swapBinary(exe, exe+".new"); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(exe); got != "v2" {
+			t.Errorf("binary = %s, want v2", got)
+		}
+		if got := read(exe + ".new"); got != "missing" {
+			t.Errorf("staged copy = %s, want it moved into place", got)
+		}
+		// Windows keeps the running copy until the next start
+		if got := read(exe + ".old"); got != "missing" && (runtime.GOOS != "windows" || got != "v1") {
+			t.Errorf("old copy = %s", got)
+		}
+	})
+
+	t.Run("nothing staged", func(t *testing.T) {
+		exe := writeBinaries(t, map[string]string{"araxiapatch": "v1"})
+		if err := swapBinary(exe, exe+".new"); err == nil {
+			t.Fatal("swapped in a missing binary")
+		}
+		if got := read(exe); got != "v1" {
+			t.Errorf("binary = %s after the failed swap, want v1 put back", got)
+		}
+	})
+}
@@ -0,0 +1,526 @@
+//go:build !nogui
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/therecipe/qt/core"
+	"github.com/therecipe/qt/widgets"
+	"github.com/turleynerd/araxiapatch/i18n"
+	"github.com/turleynerd/araxiapatch/patch"
+)
+
+// Built with Qt, a window is shown whenever there is a display
+const guiAvailable = true
+
+type ProgressBarWindow struct {
+	app          *widgets.QApplication
+	window       *widgets.QWidget
+	layout       *widgets.QVBoxLayout
+	bars         []*ProgressBar
+	overall      *widgets.QProgressBar
+	overallSpeed *widgets.QLabel
+	// Latest overall figures, painted by the UI timer
+	overallProgress snapshot[progressValue]
+	overallRate     snapshot[speedValue]
+	maxNameWidth    int // pixels
+	patcher         *patch.Patcher
+	ctx             context.Context
+	ui              chan func()
+	// The manifest request and the patch and repair runs still going, which
+	// must finish and close every file before the program exits
+	runs sync.WaitGroup
+	// Outcome of the latest run, which decides the exit code
+	result atomic.Pointer[patch.Result]
+	// What a repair needs to patch the same install again
+	client       *http.Client
+	directory    string
+	manifest     patch.Manifest
+	repairButton *widgets.QPushButton
+}
+
+type ProgressBar struct {
+	order       int
+	file        string
+	progressBar *widgets.QProgressBar
+	label       *widgets.QLabel
+	pauseButton *widgets.QPushButton
+	// Skips this file while the others carry on
+	cancelButton *widgets.QPushButton
+	// Latest figures reported by the download, painted by the UI timer
+	progress snapshot[progressValue]
+	speed    snapshot[speedValue]
+}
+
+// runGUI patches the install directory with a progress window and returns the
+// exit code once the window is closed
+func runGUI(ctx context.Context, cancel context.CancelFunc, client *http.Client, options Options) int {
+	// An interrupt and the Close button stop the patch the same way: the
+	// downloads are cancelled and the event loop ends, then runGUI waits for
+	// the patcher to close its files. Unfinished downloads stay as .part files
+	// for the next run to resume.
+	var interrupted atomic.Bool
+	shutdown := func(code int) {
+		cancel()
+		core.QCoreApplication_Exit(code)
+	}
+	catchInterrupt(ctx, func() {
+		interrupted.Store(true)
+		shutdown(exitInterrupted)
+	})
+
+	app := widgets.NewQApplication(len(os.Args), os.Args)
+	// Window setup
+	window := widgets.NewQWidget(nil, 0)
+	window.SetWindowTitle(appName)
+	title := widgets.NewQLabel2(appName, nil, 0)
+	title.Font().SetPointSize(20)
+	title.Font().SetFamily("Arial")
+	title.SetAlignment(core.Qt__AlignCenter)
+	window.SetMinimumSize2(800, 600)
+
+	// Build layout
+	layout := widgets.NewQVBoxLayout()
+	window.SetLayout(layout)
+	layout.AddWidget(title, 0, core.Qt__AlignCenter)
+
+	// The picker starts from the directory used last time, -dir skips it
+	config := loadConfig()
+	if options.Directory == "" {
+		start := config.Directory
+		if start == "" {
+			start = "."
+		}
+		directory, ok := chooseDirectory(window, start)
+		if !ok {
+			return 1
+		}
+		options.Directory = directory
+	}
+	if !options.DryRun {
+		rememberDirectory(config, options.Directory)
+	}
+
+	progressBarWindow := ProgressBarWindow{
+		app:       app,
+		window:    window,
+		layout:    widgets.NewQVBoxLayout(),
+		ctx:       ctx,
+		client:    client,
+		directory: options.Directory,
+	}
+	// The bars are built once the manifest arrives; until then this says what
+	// the window is waiting for
+	loading := widgets.NewQLabel2(i18n.Tr("status.manifest"), nil, 0)
+	progressBarWindow.layout.AddWidget(loading, 0, core.Qt__AlignCenter)
+	layout.AddLayout(progressBarWindow.layout, 0)
+
+	settingsButton := widgets.NewQPushButton2(i18n.Tr("button.settings"), nil)
+	settingsButton.ConnectClicked(func(bool) {
+		progressBarWindow.showSettings()
+	})
+	// The settings are applied to the patcher, which needs the manifest first
+	settingsButton.SetEnabled(false)
+	// Offered once a run has finished, to check and fix the install in place
+	progressBarWindow.repairButton = widgets.NewQPushButton2(i18n.Tr("button.repair"), nil)
+	progressBarWindow.repairButton.ConnectClicked(func(bool) {
+		progressBarWindow.repair()
+	})
+	progressBarWindow.repairButton.SetEnabled(false)
+	closeButton := widgets.NewQPushButton2(i18n.Tr("button.close"), nil)
+	closeButton.ConnectClicked(func(bool) {
+		shutdown(0)
+	})
+	buttonLayout := widgets.NewQHBoxLayout2(nil)
+	buttonLayout.AddWidget(settingsButton, 0, core.Qt__AlignLeft)
+	buttonLayout.AddWidget(progressBarWindow.repairButton, 0, core.Qt__AlignLeft)
+	buttonLayout.AddStretch(1)
+	buttonLayout.AddWidget(closeButton, 0, core.Qt__AlignRight)
+	layout.AddLayout(buttonLayout, 0)
+
+	progressBarWindow.startUI()
+
+	// Requests run off the main thread, so the window can still be moved and
+	// closed while a slow server answers
+	planned := false
+	progressBarWindow.runs.Add(1)
+	go func() {
+		defer progressBarWindow.runs.Done()
+		manifest, err := patch.FetchManifest(ctx, client, settings.Sources())
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Unable to fetch manifest", "err", err)
+			progressBarWindow.onMain(func() {
+				widgets.QMessageBox_Critical(window, appName, i18n.Tr("dialog.manifest", err.Error()), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+				shutdown(1)
+			})
+			return
+		}
+		files = manifest.Files
+
+		if launcherTooOld(manifest) {
+			slog.Error("Patcher too old for this patch", "required", manifest.MinPatcherVersion, "running", launcherVersion)
+			progressBarWindow.onMain(func() {
+				refuseOutdated(ctx, client, window, manifest)
+				shutdown(1)
+			})
+			return
+		}
+		if launcherOutdated(manifest) && !progressBarWindow.onMainWait(func() { offerUpdate(ctx, client, window, manifest) }) {
+			return
+		}
+
+		if options.DryRun {
+			plan := patch.New(ctx, client, patchConfig(options.Directory), manifest, nil).Plan()
+			planned = ctx.Err() == nil
+			progressBarWindow.onMain(func() {
+				widgets.QMessageBox_Information(window, appName, i18n.Tr("dialog.dryRun", planText(plan)), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+				app.Quit()
+			})
+			return
+		}
+
+		var patcher *patch.Patcher
+		started := progressBarWindow.onMainWait(func() {
+			loading.Hide()
+			progressBarWindow.showPatch(manifest)
+			settingsButton.SetEnabled(true)
+			patcher = progressBarWindow.patcher
+		})
+		if started {
+			patcher.Run()
+		}
+	}()
+
+	window.Show()
+
+	code := app.Exec()
+
+	// Let in-flight requests stop and downloads close their files before exiting
+	cancel()
+	progressBarWindow.runs.Wait()
+	if code != 0 {
+		return code
+	}
+	if planned {
+		return 0
+	}
+	return exitCode(progressBarWindow.result.Load(), interrupted.Load())
+}
+
+// showPatch adds the overall bar and a bar for each file in manifest, and the
+// patcher that reports to them. It runs on the main thread.
+func (p *ProgressBarWindow) showPatch(manifest patch.Manifest) {
+	p.overall = widgets.NewQProgressBar(nil)
+	p.overall.SetTextVisible(true)
+	// Busy until every file has reported its size
+	p.overall.SetRange(0, 0)
+	p.overallSpeed = widgets.NewQLabel2("", nil, 0)
+	overallLayout := widgets.NewQHBoxLayout2(nil)
+	overallLayout.AddWidget(p.overall, 1, 0)
+	overallLayout.AddWidget(p.overallSpeed, 0, core.Qt__AlignRight)
+	p.layout.AddLayout(overallLayout, 0)
+
+	p.manifest = manifest
+	p.patcher = patch.New(p.ctx, p.client, patchConfig(p.directory), manifest, p)
+	p.calculateMaxNameWidth()
+	p.initProgressBars()
+}
+
+// repair runs the patch again with Config.Repair, reusing the bars: files
+// found intact say so and only the others are downloaded. It runs on the
+// main thread once the previous run has finished.
+func (p *ProgressBarWindow) repair() {
+	p.repairButton.SetEnabled(false)
+	for _, bar := range p.bars {
+		bar.reset()
+	}
+	p.overallProgress.set(progressValue{0, -1})
+	p.overallRate.set(speedValue{remaining: -1})
+
+	config := patchConfig(p.directory)
+	config.Repair = true
+	patcher := patch.New(p.ctx, p.client, config, p.manifest, p)
+	p.patcher = patcher
+	p.runs.Add(1)
+	go func() {
+		defer p.runs.Done()
+		patcher.Run()
+	}()
+}
+
+// offerUpdate asks whether to install the newer patcher the manifest names
+// and does so if the player agrees. The patch goes ahead either way.
+func offerUpdate(ctx context.Context, client *http.Client, parent widgets.QWidget_ITF, manifest patch.Manifest) {
+	answer := widgets.QMessageBox_Question(parent, appName, i18n.Tr("dialog.updateAvailable", manifest.LauncherVersion, launcherVersion), widgets.QMessageBox__Yes|widgets.QMessageBox__No, widgets.QMessageBox__Yes)
+	if answer == widgets.QMessageBox__Yes {
+		installUpdate(ctx, client, parent, manifest)
+	}
+}
+
+// refuseOutdated tells the player this patcher is too old to apply the patch,
+// offering to install the newer release when the manifest names one that is
+// recent enough
+func refuseOutdated(ctx context.Context, client *http.Client, parent widgets.QWidget_ITF, manifest patch.Manifest) {
+	if !updateSatisfies(manifest) {
+		widgets.QMessageBox_Critical(parent, appName, i18n.Tr("dialog.tooOld", manifest.MinPatcherVersion, launcherVersion), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		return
+	}
+	answer := widgets.QMessageBox_Question(parent, appName, i18n.Tr("dialog.tooOldUpdate", manifest.MinPatcherVersion, launcherVersion, manifest.LauncherVersion), widgets.QMessageBox__Yes|widgets.QMessageBox__No, widgets.QMessageBox__Yes)
+	if answer == widgets.QMessageBox__Yes {
+		installUpdate(ctx, client, parent, manifest)
+	}
+}
+
+// installUpdate installs the patcher release the manifest names and tells the
+// player whether it worked
+func installUpdate(ctx context.Context, client *http.Client, parent widgets.QWidget_ITF, manifest patch.Manifest) {
+	if err := updateLauncher(ctx, client, manifest); err != nil {
+		slog.Error("Unable to update patcher", "err", err)
+		widgets.QMessageBox_Warning(parent, appName, i18n.Tr("dialog.updateFailed", err.Error()), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		return
+	}
+	widgets.QMessageBox_Information(parent, appName, i18n.Tr("dialog.updated"), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+}
+
+// chooseDirectory asks where the client is installed, starting from start, and
+// asks again until the player picks a directory that can be written to. It
+// returns false if the dialog is cancelled.
+func chooseDirectory(parent widgets.QWidget_ITF, start string) (string, bool) {
+	for {
+		directory := widgets.QFileDialog_GetExistingDirectory(parent, i18n.Tr("dialog.chooseDir"), start, widgets.QFileDialog__ShowDirsOnly)
+		if directory == "" {
+			return "", false
+		}
+
+		err := patch.CheckWritable(directory)
+		if err == nil {
+			return directory, true
+		}
+		slog.Warn("Directory is not writable", "directory", directory, "err", err)
+		widgets.QMessageBox_Warning(parent, appName, i18n.Tr("dialog.notWritable", err.Error()), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		start = directory
+	}
+}
+
+// Widest a file name label may get in pixels before the name is elided
+var maxNameLabelWidth = 320
+
+// calculateMaxNameWidth sizes the name labels to fit the widest file name in
+// the window's font, up to maxNameLabelWidth
+func (p *ProgressBarWindow) calculateMaxNameWidth() {
+	p.maxNameWidth = nameWidth(files, p.textWidth, maxNameLabelWidth)
+}
+
+// textWidth measures text in pixels in the window's font
+func (p *ProgressBarWindow) textWidth(text string) int {
+	return p.window.FontMetrics().HorizontalAdvance(text, -1)
+}
+
+func (p *ProgressBarWindow) initProgressBars() {
+	for i, file := range files {
+		progressBar := NewProgressBar(i+1, file)
+		p.bars = append(p.bars, progressBar)
+		progressBar.pauseButton.ConnectClicked(func(bool) {
+			if p.patcher.TogglePause(progressBar.order) {
+				// A speed still waiting to be painted would hide the status
+				progressBar.speed.take()
+				progressBar.pauseButton.SetText(i18n.Tr("button.resume"))
+				progressBar.label.SetText(i18n.Tr("status.paused"))
+			} else {
+				progressBar.pauseButton.SetText(i18n.Tr("button.pause"))
+				progressBar.label.SetText("")
+			}
+		})
+		progressBar.cancelButton.ConnectClicked(func(bool) {
+			progressBar.pauseButton.SetEnabled(false)
+			progressBar.cancelButton.SetEnabled(false)
+			p.patcher.Cancel(progressBar.order)
+		})
+
+		// Create labels for filename and download speed. Names too long for
+		// the label are shortened in the middle; the tooltip has all of it.
+		name := elideMiddle(file, p.maxNameWidth, p.textWidth)
+		filenameLabel := widgets.NewQLabel2(name, nil, 0)
+		filenameLabel.SetFixedWidth(p.maxNameWidth)
+		filenameLabel.SetToolTip(file)
+
+		// Create a horizontal layout for the labels and progress bar
+		labelLayout := widgets.NewQHBoxLayout2(nil)
+		labelLayout.AddWidget(filenameLabel, 0, core.Qt__AlignTop)
+		// The status takes the room left by the name, however long it gets
+		labelLayout.AddWidget(progressBar.label, 1, core.Qt__AlignTop)
+		labelLayout.AddWidget(progressBar.pauseButton, 0, core.Qt__AlignRight)
+		labelLayout.AddWidget(progressBar.cancelButton, 0, core.Qt__AlignRight)
+
+		// Create a vertical layout to hold the labels and progress bar
+		progressLayout := widgets.NewQVBoxLayout()
+		progressLayout.AddLayout(labelLayout, 0)
+		progressLayout.AddWidget(progressBar.progressBar, 0, core.Qt__AlignTop)
+
+		p.layout.AddLayout(progressLayout, 0)
+	}
+}
+
+func (p *ProgressBarWindow) FileStatus(order int, status string) {
+	bar := p.bars[order-1]
+	p.onMain(func() {
+		bar.clearFailed()
+		bar.label.SetText(status)
+	})
+}
+
+func (p *ProgressBarWindow) FileProgress(order int, current int64, total int64) {
+	p.bars[order-1].progress.set(progressValue{current, total})
+}
+
+func (p *ProgressBarWindow) FileSpeed(order int, speed float64, remaining int64) {
+	p.bars[order-1].speed.set(speedValue{speed, remaining})
+}
+
+// FileFailed marks the bar failed, keeping the full error in the tooltip
+func (p *ProgressBarWindow) FileFailed(order int, reason string, err error) {
+	bar := p.bars[order-1]
+	p.onMain(func() {
+		bar.markFailed(reason)
+		bar.label.SetToolTip(err.Error())
+	})
+}
+
+// OverallSpeed shows the combined rate next to the overall bar, blank when idle
+func (p *ProgressBarWindow) OverallSpeed(speed float64) {
+	p.overallRate.set(speedValue{speed: speed, remaining: -1})
+}
+
+func (p *ProgressBarWindow) DownloadFinished(order int) {
+	bar := p.bars[order-1]
+	p.onMain(func() {
+		bar.pauseButton.SetEnabled(false)
+		bar.cancelButton.SetEnabled(false)
+	})
+}
+
+func (p *ProgressBarWindow) Overall(current int64, total int64) {
+	p.overallProgress.set(progressValue{current, total})
+}
+
+func (p *ProgressBarWindow) Error(message string) {
+	p.onMain(func() {
+		widgets.QMessageBox_Critical(p.window, appName, message, widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+	})
+}
+
+func (p *ProgressBarWindow) Finished(result *patch.Result) {
+	p.result.Store(result)
+	p.onMain(func() { p.repairButton.SetEnabled(true) })
+	if failed := result.Failures(); len(failed) > 0 && p.ctx.Err() == nil {
+		p.onMain(func() { p.showFailures(failed) })
+		return
+	}
+	if !result.Success {
+		return
+	}
+
+	// With -launch the patcher gets out of the way of the game
+	launched, err := launchIfPatched(result)
+	p.onMain(func() {
+		switch {
+		case err != nil:
+			slog.Error("Unable to launch game", "path", launchPath, "err", err)
+			widgets.QMessageBox_Warning(p.window, appName, i18n.Tr("dialog.launchFailed", err.Error()), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		case launched:
+			p.app.Quit()
+		case result.UpToDate:
+			widgets.QMessageBox_Information(p.window, appName, i18n.Tr("dialog.upToDate"), widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		default:
+			text := i18n.Tr("dialog.complete")
+			if result.Repair {
+				text = repairSummary(result)
+			}
+			if unverified := result.Unverified(); len(unverified) > 0 {
+				text += "\n\n" + i18n.Tr("dialog.unverified", len(unverified))
+			}
+			widgets.QMessageBox_Information(p.window, appName, text, widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+		}
+	})
+}
+
+// showFailures tells the player which files could not be patched
+func (p *ProgressBarWindow) showFailures(failed []patch.FileResult) {
+	text := i18n.Tr("dialog.failures") + "\n"
+	for _, file := range failed {
+		text += "\n" + file.File + ": " + file.Error
+	}
+	widgets.QMessageBox_Warning(p.window, appName, text, widgets.QMessageBox__Ok, widgets.QMessageBox__Ok)
+}
+
+func NewProgressBar(order int, file string) *ProgressBar {
+	progressBar := widgets.NewQProgressBar(nil)
+	progressBar.SetMinimum(0)
+	progressBar.SetMaximum(100)
+	progressBar.SetValue(0)
+	// Centered text drawn with the palette colors stays readable in light and dark themes
+	progressBar.SetTextVisible(true)
+	progressBar.SetAlignment(core.Qt__AlignCenter)
+	progressBar.SetFormat(progressFormat(0, 0))
+
+	label := widgets.NewQLabel2("", nil, 0)
+
+	return &ProgressBar{
+		order:        order,
+		file:         file,
+		progressBar:  progressBar,
+		label:        label,
+		pauseButton:  widgets.NewQPushButton2(i18n.Tr("button.pause"), nil),
+		cancelButton: widgets.NewQPushButton2(i18n.Tr("button.cancel"), nil),
+	}
+}
+
+// markFailed turns the bar red and replaces the speed text with the reason
+func (b *ProgressBar) markFailed(reason string) {
+	b.progressBar.SetStyleSheet("QProgressBar::chunk { background-color: #c0392b; }")
+	b.label.SetText(reason)
+}
+
+// reset empties the bar for another run over the same file
+func (b *ProgressBar) reset() {
+	b.clearFailed()
+	b.label.SetText("")
+	b.label.SetToolTip("")
+	b.progress.set(progressValue{0, 0})
+	b.speed.take()
+	b.progressBar.SetValue(0)
+	b.pauseButton.SetText(i18n.Tr("button.pause"))
+	b.pauseButton.SetEnabled(true)
+	b.cancelButton.SetEnabled(true)
+}
+
+// clearFailed restores the default bar color before another attempt
+func (b *ProgressBar) clearFailed() {
+	b.progressBar.SetStyleSheet("")
+}
+
+func updateProgressBar(progressBar *widgets.QProgressBar, current int64, total int64) {
+	progressBar.SetFormat(progressFormat(current, total))
+	if total <= 0 {
+		return
+	}
+	progressBar.SetValue(percent(current, total))
+}
+
+// progressFormat builds the bar text, e.g. "142.3 / 320.0 MB (44%)". Qt
+// substitutes %p with the percentage, so it is only used when the total is known.
+func progressFormat(current int64, total int64) string {
+	if total <= 0 {
+		return sizeText(current, total)
+	}
+	return sizeText(current, total) + " (%p%)"
+}
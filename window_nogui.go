@@ -0,0 +1,19 @@
+//go:build nogui
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/turleynerd/araxiapatch/i18n"
+)
+
+// Built without Qt, every run shows its progress as text
+const guiAvailable = false
+
+func runGUI(ctx context.Context, cancel context.CancelFunc, client *http.Client, options Options) int {
+	fmt.Println(i18n.Tr("text.noGUI"))
+	return runHeadless(ctx, cancel, client, options)
+}